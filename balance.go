@@ -0,0 +1,251 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Strategies for choosing which of a server's endpoints a new session
+// goes to.
+const (
+	// balanceFailover tries the endpoints in the order they are listed.
+	balanceFailover = "failover"
+	// balanceRoundRobin takes turns, in proportion to the weights.
+	balanceRoundRobin = "round-robin"
+	// balanceLeastActive picks the endpoint with the fewest active sessions
+	// relative to its weight.
+	balanceLeastActive = "least-active"
+	// balanceRandom picks at random, in proportion to the weights.
+	balanceRandom = "random"
+	// balanceSourceHash sends each client address to the same endpoint.
+	balanceSourceHash = "source-hash"
+)
+
+func validateBalance(balance string) error {
+	switch balance {
+	case "", balanceFailover, balanceRoundRobin, balanceLeastActive,
+		balanceRandom, balanceSourceHash:
+		return nil
+	}
+	return fmt.Errorf("unknown balance strategy `%s`", balance)
+}
+
+// weight is the endpoint's share of sessions, relative to the other
+// endpoints of its server.
+func (ep *endpoint) weight() int {
+	if ep.Weight == 0 {
+		return 1
+	}
+	return ep.Weight
+}
+
+// endpointOrder returns the server's endpoints in the order they should be
+// tried for a client connecting from src. Healthy endpoints come first,
+// starting with the one the server's balance strategy picks and followed
+// by the rest in the order they are listed, then any unhealthy endpoints as
+// a last resort. A session is reserved on the first endpoint (see
+// sessionTracker.reserve).
+func (s *ServerConfig) endpointOrder(src net.Addr) []*endpoint {
+	var healthy, unhealthy []*endpoint
+	for _, ep := range s.endpoints() {
+		if endpointHealth.healthy(ep.address()) {
+			healthy = append(healthy, ep)
+		} else {
+			unhealthy = append(unhealthy, ep)
+		}
+	}
+
+	var reserved bool
+	if len(healthy) > 1 {
+		var i int
+		switch s.Balance {
+		case balanceRoundRobin:
+			i = roundRobin.next(s.Name, healthy)
+		case balanceLeastActive:
+			i = sessions.reserveLeastActive(healthy)
+			reserved = true
+		case balanceRandom:
+			i = weightedIndex(healthy, rand.Intn(totalWeight(healthy)))
+		case balanceSourceHash:
+			h := fnv.New32a()
+			if src != nil {
+				h.Write([]byte(clientIP(src)))
+			}
+			i = weightedIndex(healthy,
+				int(h.Sum32()%uint32(totalWeight(healthy))))
+		}
+		if i > 0 {
+			chosen := healthy[i]
+			copy(healthy[1:i+1], healthy[:i])
+			healthy[0] = chosen
+		}
+	}
+
+	order := append(healthy, unhealthy...)
+	if !reserved && len(order) > 0 {
+		sessions.reserve(order[0].address())
+	}
+	return order
+}
+
+func totalWeight(eps []*endpoint) int {
+	var total int
+	for _, ep := range eps {
+		total += ep.weight()
+	}
+	return total
+}
+
+// weightedIndex returns the index of the endpoint that n, from 0 up to the
+// total weight of eps, falls on when each endpoint is given a range of
+// numbers as wide as its weight.
+func weightedIndex(eps []*endpoint, n int) int {
+	for i, ep := range eps {
+		n -= ep.weight()
+		if n < 0 {
+			return i
+		}
+	}
+	return len(eps) - 1
+}
+
+// roundRobinState remembers where each server is in its rotation, using
+// the smooth weighted round-robin algorithm, which spreads each endpoint's
+// turns out rather than giving them all at once.
+type roundRobinState struct {
+	mu      sync.Mutex
+	current map[string]map[string]int
+}
+
+var roundRobin = &roundRobinState{current: make(map[string]map[string]int)}
+
+// next returns the index of the endpoint whose turn it is.
+func (rr *roundRobinState) next(server string, eps []*endpoint) int {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	current := rr.current[server]
+	if current == nil {
+		current = make(map[string]int)
+		rr.current[server] = current
+	}
+
+	best := 0
+	for i, ep := range eps {
+		current[ep.address()] += ep.weight()
+		if current[ep.address()] > current[eps[best].address()] {
+			best = i
+		}
+	}
+	current[eps[best].address()] -= totalWeight(eps)
+	return best
+}
+
+// prune forgets the rotation of servers and endpoints that aren't in
+// config.
+func (rr *roundRobinState) prune(config *Config) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	servers := make(map[string]*ServerConfig)
+	for i := range config.Servers {
+		servers[config.Servers[i].Name] = &config.Servers[i]
+	}
+	for name, current := range rr.current {
+		s, ok := servers[name]
+		if !ok {
+			delete(rr.current, name)
+			continue
+		}
+		addrs := make(map[string]bool)
+		for _, ep := range s.endpoints() {
+			addrs[ep.address()] = true
+		}
+		for addr := range current {
+			if !addrs[addr] {
+				delete(current, addr)
+			}
+		}
+	}
+}
+
+// unhealthyRetry is how long an endpoint that we failed to connect to is
+// passed over in favor of the server's other endpoints.
+const unhealthyRetry = 30 * time.Second
+
+// healthTracker remembers which endpoints we have recently failed to
+// connect to, and the results of the last health checks, by address.
+type healthTracker struct {
+	mu        sync.Mutex
+	unhealthy map[string]time.Time
+	checks    map[string]healthResult
+}
+
+var endpointHealth = &healthTracker{
+	unhealthy: make(map[string]time.Time),
+	checks:    make(map[string]healthResult),
+}
+
+// healthy reports whether the endpoint at addr is fit for new sessions: we
+// haven't recently failed to connect to it, and its last health check, if
+// any, succeeded.
+func (h *healthTracker) healthy(addr string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if result, ok := h.checks[addr]; ok && result.err != nil {
+		return false
+	}
+	until, ok := h.unhealthy[addr]
+	return !ok || time.Now().After(until)
+}
+
+// failed marks the endpoint unhealthy after a failed connection attempt.
+func (h *healthTracker) failed(ep *endpoint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	addr := ep.address()
+	if until, ok := h.unhealthy[addr]; !ok || time.Now().After(until) {
+		l.Log(WarnLvl, "Endpoint %s of server `%s` marked unhealthy", addr,
+			ep.server.Name)
+	}
+	h.unhealthy[addr] = time.Now().Add(unhealthyRetry)
+}
+
+// succeeded marks the endpoint healthy after a successful connection,
+// overriding a failed health check until the next one.
+func (h *healthTracker) succeeded(ep *endpoint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	addr := ep.address()
+	_, marked := h.unhealthy[addr]
+	result, checked := h.checks[addr]
+	if marked || (checked && result.err != nil) {
+		l.Log(InfoLvl, "Endpoint %s of server `%s` is healthy again", addr,
+			ep.server.Name)
+		delete(h.unhealthy, addr)
+	}
+	if checked && result.err != nil {
+		delete(h.checks, addr)
+	}
+}
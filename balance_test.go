@@ -0,0 +1,97 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEndpointOrder(t *testing.T) {
+	// Each call reserves a session on the endpoint it picks.
+	tracker := sessions
+	sessions = newSessionTracker()
+	defer func() { sessions = tracker }()
+
+	server := &ServerConfig{Name: "pool", Endpoints: []EndpointConfig{
+		{Host: "a.example.com", Port: 23, Weight: 2},
+		{Host: "b.example.com", Port: 23},
+		{Host: "c.example.com", Port: 23},
+	}}
+	first := func(src net.Addr) string {
+		return server.endpointOrder(src)[0].Host
+	}
+	count := func(src net.Addr, n int) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			counts[first(src)]++
+		}
+		return counts
+	}
+
+	if got := first(nil); got != "a.example.com" {
+		t.Errorf("failover: got %s first; we expected a.example.com", got)
+	}
+
+	server.Balance = balanceRoundRobin
+	if got := count(nil, 8); got["a.example.com"] != 4 ||
+		got["b.example.com"] != 2 || got["c.example.com"] != 2 {
+		t.Errorf("round-robin: got %v; we expected 4/2/2", got)
+	}
+	roundRobin.prune(&Config{Servers: []ServerConfig{{Name: "pool",
+		Endpoints: server.Endpoints[:1]}}})
+	if current := roundRobin.current["pool"]; len(current) != 1 {
+		t.Errorf("round-robin: kept %v after reload; we expected only a.example.com", current)
+	}
+
+	server.Balance = balanceRandom
+	if got := count(nil, 100); len(got) < 2 {
+		t.Errorf("random: got %v; we expected a mix", got)
+	}
+
+	server.Balance = balanceSourceHash
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 1234}
+	if got := count(client, 10); len(got) != 1 {
+		t.Errorf("source-hash: got %v; we expected the same endpoint every time", got)
+	}
+
+	// A burst of sessions, none of which has connected yet, is spread out
+	// in proportion to the endpoints' weights, and a failed connection
+	// gives up its place.
+	server.Balance = balanceLeastActive
+	sessions = newSessionTracker()
+	if got := count(nil, 8); got["a.example.com"] != 4 ||
+		got["b.example.com"] != 2 || got["c.example.com"] != 2 {
+		t.Errorf("least-active: got %v; we expected 4/2/2", got)
+	}
+	sessions.release("b.example.com:23")
+	if got := first(nil); got != "b.example.com" {
+		t.Errorf("least-active: got %s first; we expected b.example.com", got)
+	}
+
+	// Unhealthy endpoints go last, whatever the strategy.
+	eps := server.endpoints()
+	endpointHealth.failed(eps[0])
+	defer endpointHealth.succeeded(eps[0])
+	order := server.endpointOrder(nil)
+	if order[0].Host == "a.example.com" || order[2].Host != "a.example.com" {
+		t.Errorf("unhealthy endpoint a.example.com should be tried last")
+	}
+}
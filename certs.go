@@ -0,0 +1,171 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often we look for changes to certificate files.
+const certCheckInterval = 30 * time.Second
+
+// certPair is one certificate and private key loaded from disk.
+type certPair struct {
+	certFile, keyFile string
+
+	// The modification times of the files when we last tried to load them,
+	// so we only try again when they change.
+	certMod, keyMod time.Time
+
+	cert *tls.Certificate
+}
+
+// certStore holds the certificates a TLS listener serves. The certificate
+// is chosen for each connection based on the server name the client asks
+// for (SNI), and the files are reloaded when they change so certificates
+// can be renewed without a restart.
+type certStore struct {
+	mu    sync.RWMutex
+	pairs []*certPair
+
+	// reloadMu keeps reloads from the file watcher and from SIGHUP from
+	// running at the same time.
+	reloadMu sync.Mutex
+}
+
+// newCertStore loads the certificate pairs. The first pair is the default,
+// used when a client doesn't send a server name or none of the
+// certificates match it.
+func newCertStore(pairs []CertificateConfig) (*certStore, error) {
+	store := &certStore{}
+	for _, p := range pairs {
+		pair := &certPair{certFile: p.Certificate, keyFile: p.Key}
+		if err := pair.load(); err != nil {
+			return nil, err
+		}
+		store.pairs = append(store.pairs, pair)
+	}
+	return store, nil
+}
+
+func (p *certPair) load() error {
+	var err error
+	p.certMod, p.keyMod, err = p.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return fmt.Errorf("couldn't load X.509 certificate %s: %v",
+			p.certFile, err)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("couldn't parse X.509 certificate %s: %v",
+				p.certFile, err)
+		}
+	}
+	p.cert = &cert
+	return nil
+}
+
+func (p *certPair) modTimes() (certMod, keyMod time.Time, err error) {
+	fi, err := os.Stat(p.certFile)
+	if err != nil {
+		return certMod, keyMod, err
+	}
+	certMod = fi.ModTime()
+	fi, err = os.Stat(p.keyFile)
+	if err != nil {
+		return certMod, keyMod, err
+	}
+	keyMod = fi.ModTime()
+	return certMod, keyMod, nil
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (store *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if hello.ServerName != "" {
+		for _, p := range store.pairs {
+			if p.cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return p.cert, nil
+			}
+		}
+	}
+	return store.pairs[0].cert, nil
+}
+
+// reload loads any certificate pairs whose files have changed since we last
+// loaded them. If force is true, every pair is loaded again regardless. If a
+// pair fails to load, the error is logged and the previous certificate
+// remains in use.
+func (store *certStore) reload(force bool) {
+	store.reloadMu.Lock()
+	defer store.reloadMu.Unlock()
+
+	for i := range store.pairs {
+		store.mu.RLock()
+		old := store.pairs[i]
+		store.mu.RUnlock()
+
+		certMod, keyMod, err := old.modTimes()
+		if err != nil {
+			l.LogWithErr(ErrorLvl, err, "Couldn't check certificate %s",
+				old.certFile)
+			continue
+		}
+		if !force && certMod.Equal(old.certMod) && keyMod.Equal(old.keyMod) {
+			continue
+		}
+
+		pair := &certPair{certFile: old.certFile, keyFile: old.keyFile}
+		if err := pair.load(); err != nil {
+			l.LogWithErr(ErrorLvl, err, "Keeping previous certificate")
+			// Don't try again until the files change again.
+			old.certMod, old.keyMod = certMod, keyMod
+			continue
+		}
+
+		store.mu.Lock()
+		store.pairs[i] = pair
+		store.mu.Unlock()
+		l.Log(InfoLvl, "Loaded certificate %s for %v, expires %s",
+			pair.certFile, pair.cert.Leaf.DNSNames,
+			pair.cert.Leaf.NotAfter.Format("2006-01-02"))
+	}
+}
+
+// watch checks for changed certificate files every interval. It never
+// returns.
+func (store *certStore) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		store.reload(false)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitBreakerConfig controls when we stop trying to connect to a server
+// that keeps failing. It may be set globally and overridden for individual
+// servers; settings left at zero are taken from the global configuration,
+// or the defaults. The breaker is off unless failures is set.
+type CircuitBreakerConfig struct {
+	// Failures is the number of connection attempts in a row that must
+	// fail before the breaker opens.
+	Failures int `json:"failures"`
+
+	// Cooldown is how long the breaker stays open before it lets a trial
+	// connection through.
+	Cooldown Duration `json:"cooldown"`
+}
+
+const defaultBreakerCooldown = 30 * time.Second
+
+// circuitBreaker returns the circuit breaker settings in effect for target.
+func (c *Config) circuitBreaker(target *ServerConfig) CircuitBreakerConfig {
+	cb := CircuitBreakerConfig{Cooldown: Duration(defaultBreakerCooldown)}
+	for _, override := range []*CircuitBreakerConfig{c.CircuitBreaker,
+		target.CircuitBreaker} {
+		if override == nil {
+			continue
+		}
+		if override.Failures != 0 {
+			cb.Failures = override.Failures
+		}
+		if override.Cooldown != 0 {
+			cb.Cooldown = override.Cooldown
+		}
+	}
+	return cb
+}
+
+func (cb *CircuitBreakerConfig) validate() error {
+	if cb == nil {
+		return nil
+	}
+	if cb.Failures < 0 || cb.Cooldown < 0 {
+		return errors.New("circuit breaker settings must not be negative")
+	}
+	return nil
+}
+
+// breakerState is the state of a server's circuit breaker. While it is
+// closed, connections are made as usual. Once enough of them fail in a row,
+// it opens and users who select the server are turned away without trying.
+// After the cooldown, it is half-open: one trial connection is let through,
+// and the breaker closes if it succeeds or opens again if it fails.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker is the state of one server's breaker. In the open state,
+// since is when it opened; in the half-open state, it's when the trial
+// connection was let through.
+type circuitBreaker struct {
+	state    breakerState
+	failures int
+	since    time.Time
+}
+
+// breakerTracker holds the circuit breakers of every server by name, so
+// they survive configuration reloads.
+type breakerTracker struct {
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+var breakers = &breakerTracker{breakers: make(map[string]*circuitBreaker)}
+
+// allow reports whether a user may try to connect to target now. If not,
+// it also returns how long until the breaker will let a connection through.
+// When the cooldown of an open breaker has passed, the caller's connection
+// is the trial, and its outcome must be passed to record.
+func (t *breakerTracker) allow(config *Config, target *ServerConfig) (bool, time.Duration) {
+	cb := config.circuitBreaker(target)
+	if cb.Failures == 0 {
+		return true, 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.breakers[target.Name]
+	if !ok || b.state == breakerClosed {
+		return true, 0
+	}
+
+	// A trial connection that we never heard back from, because the user
+	// left before it was made, is given up on after another cooldown.
+	wait := time.Until(b.since.Add(time.Duration(cb.Cooldown)))
+	if wait > 0 {
+		return false, wait
+	}
+	b.state = breakerHalfOpen
+	b.since = time.Now()
+	l.Log(InfoLvl, "Circuit breaker for server `%s` is half-open; letting a trial connection through",
+		target.Name)
+	return true, 0
+}
+
+// record updates target's circuit breaker with the outcome of a connection
+// attempt. A server that presented a changed certificate was reachable, so
+// that doesn't count as a failure.
+func (t *breakerTracker) record(config *Config, target *ServerConfig, err error) {
+	cb := config.circuitBreaker(target)
+	if cb.Failures == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.breakers[target.Name]
+	if !ok {
+		b = &circuitBreaker{}
+		t.breakers[target.Name] = b
+	}
+
+	var changed *certChangedError
+	if err == nil || errors.As(err, &changed) {
+		if b.state != breakerClosed {
+			l.Log(InfoLvl, "Circuit breaker for server `%s` closed; the server is reachable again",
+				target.Name)
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	switch {
+	case b.state == breakerHalfOpen:
+		l.LogWithErr(WarnLvl, err, "Circuit breaker for server `%s` opened again after the trial connection failed; failing fast for %s",
+			target.Name, time.Duration(cb.Cooldown))
+	case b.state == breakerClosed && b.failures >= cb.Failures:
+		l.LogWithErr(WarnLvl, err, "Circuit breaker for server `%s` opened after %d failed connections in a row; failing fast for %s",
+			target.Name, b.failures, time.Duration(cb.Cooldown))
+	default:
+		return
+	}
+	b.state = breakerOpen
+	b.since = time.Now()
+}
+
+// breakerMessage explains to a user that they can't connect to a server
+// because its circuit breaker is open, and when to try again.
+func breakerMessage(wait time.Duration) string {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	unit := "seconds"
+	if seconds == 1 {
+		unit = "second"
+	}
+	return fmt.Sprintf("Connections to this server keep failing. Please try again in %d %s.",
+		seconds, unit)
+}
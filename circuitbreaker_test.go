@@ -0,0 +1,81 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	config := &Config{
+		CircuitBreaker: &CircuitBreakerConfig{Failures: 5, Cooldown: Duration(time.Hour)},
+		Servers: []ServerConfig{{Name: "Test",
+			CircuitBreaker: &CircuitBreakerConfig{Failures: 2}}},
+	}
+	target := &config.Servers[0]
+	if cb := config.circuitBreaker(target); cb.Failures != 2 ||
+		cb.Cooldown != Duration(time.Hour) {
+		t.Errorf("got settings %+v; we expected 2 failures and a 1h cooldown", cb)
+	}
+	target.CircuitBreaker.Cooldown = Duration(50 * time.Millisecond)
+
+	tracker := &breakerTracker{breakers: make(map[string]*circuitBreaker)}
+	refused := errors.New("connection refused")
+	changed := &certChangedError{server: "Test"}
+	// Each test case waits, asks whether a connection is allowed, and if
+	// so, records its result unless the result is pending.
+	type TestCase struct {
+		Name     string
+		Wait     time.Duration
+		Expected bool // should the connection be allowed?
+		Result   error
+	}
+
+	pending := errors.New("pending")
+	testCases := []TestCase{
+		{"closed", 0, true, refused},
+		{"one failure", 0, true, changed},
+		{"changed certificate isn't a failure", 0, true, refused},
+		{"one failure again", 0, true, refused},
+		{"open", 0, false, nil},
+		{"half-open", 60 * time.Millisecond, true, pending},
+		{"trial in progress", 0, false, nil},
+		{"trial abandoned", 60 * time.Millisecond, true, refused},
+		{"open again", 0, false, nil},
+		{"half-open again", 60 * time.Millisecond, true, nil},
+		{"closed again", 0, true, nil},
+	}
+
+	for _, tc := range testCases {
+		time.Sleep(tc.Wait)
+		allowed, wait := tracker.allow(config, target)
+		if allowed != tc.Expected {
+			t.Fatalf("%s: allowed %v; we expected %v", tc.Name, allowed, tc.Expected)
+		}
+		if !allowed && (wait <= 0 || wait > 50*time.Millisecond) {
+			t.Errorf("%s: wait %s; we expected up to 50ms", tc.Name, wait)
+		}
+		if allowed && tc.Result != pending {
+			tracker.record(config, target, tc.Result)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNetworkACL(t *testing.T) {
+	type TestCase struct {
+		Allow, Deny []string
+		Addr        string
+		Expected    bool
+	}
+
+	internal := []string{"10.0.0.0/8", "2001:db8::/32"}
+	testCases := []TestCase{
+		{nil, nil, "192.0.2.10:1", true},
+		{internal, nil, "10.1.2.3:1", true},
+		{internal, nil, "[2001:db8::5]:1", true},
+		{internal, nil, "192.0.2.10:1", false},
+		{nil, []string{"192.0.2.0/24"}, "192.0.2.10:1", false},
+		{nil, []string{"192.0.2.0/24"}, "198.51.100.1:1", true},
+		{internal, []string{"10.9.0.0/16"}, "10.9.1.1:1", false},
+		{internal, []string{"10.9.0.0/16"}, "10.8.1.1:1", true},
+		{[]string{"192.0.2.10"}, nil, "[::ffff:192.0.2.10]:1", true},
+	}
+
+	for _, tc := range testCases {
+		addr, _ := net.ResolveTCPAddr("tcp", tc.Addr)
+		acl, err := parseNetworks(tc.Allow, tc.Deny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := acl.allows(addr); got != tc.Expected {
+			t.Errorf("allow %v, deny %v, %s: got %v; we expected %v",
+				tc.Allow, tc.Deny, tc.Addr, got, tc.Expected)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EndpointConfig is an address a server may be reached at, with the TLS
+// settings for connecting to it. A server entry in the configuration file
+// is itself an endpoint, unless it lists several in its endpoints option.
+type EndpointConfig struct {
+	Host                 string     `json:"host"`
+	Port                 uint       `json:"port"`
+	UseTLS               bool       `json:"secure"`
+	IgnoreCertValidation bool       `json:"ignoreCertValidation"`
+	ServerCA             string     `json:"serverCA"`
+	ServerName           string     `json:"serverName"`
+	ClientCertificate    string     `json:"clientCertificate"`
+	ClientKey            string     `json:"clientKey"`
+	Pins                 []string   `json:"pins"`
+	TrustOnFirstUse      bool       `json:"trustOnFirstUse"`
+	TLS                  *TLSPolicy `json:"tls"`
+
+	// Weight is the endpoint's share of new sessions when its server
+	// balances sessions across its endpoints. The default is 1.
+	Weight int `json:"weight"`
+}
+
+// hasSettings reports whether any endpoint settings are given. Empty lists
+// and TLS policies make no difference, so they don't count.
+func (c *EndpointConfig) hasSettings() bool {
+	policy := c.TLS.merge(nil) // a copy, never nil
+	return c.Host != "" || c.Port != 0 || c.UseTLS || c.IgnoreCertValidation ||
+		c.ServerCA != "" || c.ServerName != "" || c.ClientCertificate != "" ||
+		c.ClientKey != "" || len(c.Pins) > 0 || c.TrustOnFirstUse ||
+		c.Weight != 0 || policy.MinVersion != "" || policy.MaxVersion != "" ||
+		len(policy.CipherSuites) > 0 || len(policy.CurvePreferences) > 0 ||
+		policy.SessionTickets != nil
+}
+
+// endpoint is one address of a server, along with the server it belongs
+// to, whose settings apply to every endpoint.
+type endpoint struct {
+	*EndpointConfig
+	server *ServerConfig
+}
+
+// endpoints returns the server's endpoints in the order they should be
+// tried.
+func (s *ServerConfig) endpoints() []*endpoint {
+	if len(s.Endpoints) == 0 {
+		return []*endpoint{{EndpointConfig: &s.EndpointConfig, server: s}}
+	}
+	eps := make([]*endpoint, len(s.Endpoints))
+	for i := range s.Endpoints {
+		eps[i] = &endpoint{EndpointConfig: &s.Endpoints[i], server: s}
+	}
+	return eps
+}
+
+// address is the endpoint's host:port.
+func (ep *endpoint) address() string {
+	return net.JoinHostPort(ep.Host, strconv.Itoa(int(ep.Port)))
+}
+
+// validate checks the endpoint's settings. where describes the endpoint
+// for error messages.
+func (ep *endpoint) validate(config *Config, where string) error {
+	if len(strings.TrimSpace(ep.Host)) == 0 {
+		return fmt.Errorf("Host missing on %s", where)
+	}
+	if ep.Port == 0 {
+		return fmt.Errorf("Port missing on %s", where)
+	}
+	if ep.Port > 65535 {
+		return fmt.Errorf("Port %d invalid on %s", ep.Port, where)
+	}
+	if ep.Weight < 0 {
+		return fmt.Errorf("Weight on %s must not be negative", where)
+	}
+	if err := ep.validateTLS(config); err != nil {
+		return fmt.Errorf("TLS settings on %s: %v", where, err)
+	}
+	return nil
+}
+
+// connectServer connects to the first of the server's endpoints that will
+// have us, trying each in turn in the order endpointOrder gives. Each
+// attempt has the full dial and TLS handshake timeouts. src and dst are the
+// client connection's addresses, for balancing and the PROXY protocol
+// header. A session is reserved on the endpoint we connect to, which the
+// caller hands to its session with sessionTracker.setEndpoint.
+func connectServer(config *Config, target *ServerConfig,
+	src, dst net.Addr) (net.Conn, *endpoint, error) {
+
+	var err, changed error
+	eps := target.endpointOrder(src)
+	for i, ep := range eps {
+		if i > 0 {
+			sessions.reserve(ep.address())
+		}
+		var conn net.Conn
+		conn, err = ep.connect(config, src, dst)
+		if err == nil {
+			endpointHealth.succeeded(ep)
+			return conn, ep, nil
+		}
+		sessions.release(ep.address())
+		endpointHealth.failed(ep)
+		// A changed certificate is what we want to report if no endpoint
+		// works out, since the user gets a screen explaining it.
+		var certErr *certChangedError
+		if errors.As(err, &certErr) {
+			changed = err
+		}
+		if i < len(eps)-1 {
+			l.LogWithErr(WarnLvl, err, "Couldn't connect to server `%s` at %s; trying next endpoint",
+				target.Name, ep.address())
+		}
+	}
+	if changed != nil {
+		return nil, nil, changed
+	}
+	return nil, nil, err
+}
+
+// connect opens a connection to the endpoint, sends the PROXY protocol
+// header if the server wants one, and completes the TLS handshake if the
+// endpoint is secure.
+func (ep *endpoint) connect(config *Config, src, dst net.Addr) (net.Conn, error) {
+	timeouts := config.timeouts(ep.server)
+	conn, err := dialServer(config, ep,
+		time.Now().Add(time.Duration(timeouts.Dial)))
+	if err != nil {
+		return nil, err
+	}
+
+	// The PROXY protocol header must be the very first thing the target
+	// sees, ahead of any TLS handshake.
+	if ep.server.ProxyProtocol != 0 {
+		if err := writeProxyHeader(conn, ep.server.ProxyProtocol,
+			src, dst); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if !ep.UseTLS {
+		return conn, nil
+	}
+	tlsConfig, err := ep.tlsClientConfig(config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(
+		time.Duration(timeouts.ServerTLSHandshake)))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	l.Log(InfoLvl, "TLS connection to %s established (%s)", ep.address(),
+		describeTLS(tlsConn.ConnectionState()))
+	return tlsConn, nil
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestEndpointsConfig(t *testing.T) {
+	type TestCase struct {
+		Name      string
+		JSON      string
+		Endpoints []string // nil if the configuration is invalid
+	}
+
+	testCases := []TestCase{
+		{"single", `{"name": "A", "host": "a", "port": 23}`,
+			[]string{"a:23"}},
+		{"endpoints", `{"name": "A", "endpoints": [
+			{"host": "a", "port": 23}, {"host": "b", "port": 992, "secure": true}]}`,
+			[]string{"a:23", "b:992"}},
+		{"both", `{"name": "A", "host": "a", "port": 23,
+			"endpoints": [{"host": "b", "port": 23}]}`, nil},
+		{"endpoint without port", `{"name": "A", "endpoints": [{"host": "b"}]}`,
+			nil},
+		{"empty server settings", `{"name": "A", "pins": [], "tls": {},
+			"endpoints": [{"host": "b", "port": 23}]}`, []string{"b:23"}},
+		{"server TLS policy", `{"name": "A", "tls": {"minVersion": "1.2"},
+			"endpoints": [{"host": "b", "port": 23}]}`, nil},
+	}
+
+	for _, tc := range testCases {
+		var config Config
+		if err := json.Unmarshal([]byte(`{"servers": [`+tc.JSON+`]}`), &config); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.Name, err)
+		}
+		err := validateConfig(&config)
+		if tc.Endpoints == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error but got none", tc.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.Name, err)
+			continue
+		}
+		var got []string
+		for _, ep := range config.Servers[0].endpoints() {
+			got = append(got, ep.address())
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.Endpoints) {
+			t.Errorf("%s: got endpoints %v; we expected %v", tc.Name, got,
+				tc.Endpoints)
+		}
+	}
+}
+
+func TestConnectServerFailover(t *testing.T) {
+	// Find a port nobody is listening on.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := uint(closed.Addr().(*net.TCPAddr).Port)
+	closed.Close()
+
+	echo := echoServer(t)
+	target := &ServerConfig{Name: "Production", Endpoints: []EndpointConfig{
+		{Host: "127.0.0.1", Port: closedPort},
+		{Host: "127.0.0.1", Port: uint(echo.Port)},
+	}}
+	conn, ep, err := connectServer(&Config{}, target, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if ep.EndpointConfig != &target.Endpoints[1] {
+		t.Errorf("connected to %s; we expected the second endpoint", ep.address())
+	}
+
+	target.Endpoints = target.Endpoints[:1]
+	if _, _, err := connectServer(&Config{}, target, nil, nil); err == nil {
+		t.Errorf("expected an error with no endpoint listening")
+	}
+}
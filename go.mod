@@ -1,8 +1,13 @@
 module github.com/racingmars/proxy3270
 
-go 1.13
+go 1.24.0
 
 // To test local library changes before publishing:
 // replace github.com/racingmars/go3270 => ../go3270
 
-require github.com/racingmars/go3270 v0.9.9
+require (
+	github.com/racingmars/go3270 v0.9.9
+	golang.org/x/crypto v0.45.0
+)
+
+require golang.org/x/sys v0.38.0 // indirect
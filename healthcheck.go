@@ -0,0 +1,305 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// HealthCheckConfig controls the background checks of every server
+// endpoint, whose results are shown on the menu and used to steer sessions
+// away from endpoints that are down.
+type HealthCheckConfig struct {
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+
+	// TLS, if set, completes the TLS handshake with secure endpoints
+	// rather than only connecting to them.
+	TLS bool `json:"tls"`
+
+	// Telnet, if set, waits for the endpoint to ask for the terminal type,
+	// as a TN3270 server does first thing.
+	Telnet bool `json:"telnet"`
+
+	// Slow is the latency above which a server is shown as degraded. If
+	// zero, latency alone never makes a server degraded.
+	Slow Duration `json:"slow"`
+}
+
+const (
+	defaultHealthCheckInterval = time.Minute
+	defaultHealthCheckTimeout  = 5 * time.Second
+)
+
+// healthCheckIdle is how often we look for a health check configuration
+// when there isn't one, in case one is added by a reload.
+const healthCheckIdle = 10 * time.Second
+
+func (h *HealthCheckConfig) validate() error {
+	if h == nil {
+		return nil
+	}
+	if h.Interval < 0 || h.Timeout < 0 || h.Slow < 0 {
+		return errors.New("Health check times must not be negative")
+	}
+	return nil
+}
+
+func (h *HealthCheckConfig) interval() time.Duration {
+	if h.Interval == 0 {
+		return defaultHealthCheckInterval
+	}
+	return time.Duration(h.Interval)
+}
+
+func (h *HealthCheckConfig) timeout() time.Duration {
+	if h.Timeout == 0 {
+		return defaultHealthCheckTimeout
+	}
+	return time.Duration(h.Timeout)
+}
+
+// healthStatus is how a server looks to the health checks.
+type healthStatus int
+
+const (
+	statusUnknown healthStatus = iota
+	statusUp
+	statusDegraded
+	statusDown
+)
+
+func (s healthStatus) String() string {
+	switch s {
+	case statusUp:
+		return "UP"
+	case statusDegraded:
+		return "DEGRADED"
+	case statusDown:
+		return "DOWN"
+	}
+	return ""
+}
+
+// healthResult is the outcome of the last check of an endpoint.
+type healthResult struct {
+	err     error
+	latency time.Duration
+	checked time.Time
+}
+
+// runHealthChecks checks every endpoint of every server in the current
+// configuration, as often as the configuration says. It never returns.
+func runHealthChecks() {
+	for {
+		config := currentConfig()
+		if config.HealthCheck == nil {
+			// Results from before health checks were turned off would
+			// otherwise keep endpoints marked down forever.
+			endpointHealth.forgetChecks()
+			time.Sleep(healthCheckIdle)
+			continue
+		}
+		endpointHealth.checkAll(config)
+		time.Sleep(config.HealthCheck.interval())
+	}
+}
+
+// checkAll checks every endpoint in config at once, and forgets the
+// results for any endpoints no longer in it.
+func (h *healthTracker) checkAll(config *Config) {
+	var wg sync.WaitGroup
+	seen := make(map[string]bool)
+	for i := range config.Servers {
+		for _, ep := range config.Servers[i].endpoints() {
+			if seen[ep.address()] {
+				continue
+			}
+			seen[ep.address()] = true
+			wg.Add(1)
+			go func(ep *endpoint) {
+				defer wg.Done()
+				latency, err := ep.check(config, config.HealthCheck)
+				h.record(ep, latency, err)
+			}(ep)
+		}
+	}
+	wg.Wait()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for addr := range h.checks {
+		if !seen[addr] {
+			delete(h.checks, addr)
+		}
+	}
+}
+
+// forgetChecks discards the results of all health checks.
+func (h *healthTracker) forgetChecks() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = make(map[string]healthResult)
+}
+
+// record stores the result of a check of the endpoint, logging any change
+// between up and down.
+func (h *healthTracker) record(ep *endpoint, latency time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	addr := ep.address()
+	prev, checked := h.checks[addr]
+	h.checks[addr] = healthResult{err: err, latency: latency, checked: time.Now()}
+
+	if err != nil && (!checked || prev.err == nil) {
+		l.LogWithErr(WarnLvl, err, "Health check of endpoint %s of server `%s` failed",
+			addr, ep.server.Name)
+	} else if err == nil && checked && prev.err != nil {
+		l.Log(InfoLvl, "Endpoint %s of server `%s` is up again", addr,
+			ep.server.Name)
+	}
+	if err == nil {
+		// A successful check clears any mark from a failed connection.
+		delete(h.unhealthy, addr)
+	}
+}
+
+// serverStatus summarizes the last checks of the server's endpoints: up if
+// all of them are up, down if all of them are down, and degraded in
+// between or if they are slow. The latency is that of the quickest
+// endpoint that is up.
+func (h *healthTracker) serverStatus(config *Config, s *ServerConfig) (healthStatus, time.Duration) {
+	if config.HealthCheck == nil {
+		return statusUnknown, 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var known, up int
+	var latency time.Duration
+	for _, ep := range s.endpoints() {
+		result, ok := h.checks[ep.address()]
+		if !ok {
+			continue
+		}
+		known++
+		if result.err == nil {
+			if up == 0 || result.latency < latency {
+				latency = result.latency
+			}
+			up++
+		}
+	}
+
+	switch {
+	case known == 0:
+		return statusUnknown, 0
+	case up == 0:
+		return statusDown, 0
+	case up < known,
+		config.HealthCheck.Slow > 0 && latency > time.Duration(config.HealthCheck.Slow):
+		return statusDegraded, latency
+	}
+	return statusUp, latency
+}
+
+// check connects to the endpoint as the health check configuration
+// directs, and returns how long it took.
+func (ep *endpoint) check(config *Config, hc *HealthCheckConfig) (time.Duration, error) {
+	start := time.Now()
+	deadline := start.Add(hc.timeout())
+	conn, err := dialServer(config, ep, deadline)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// Not every connection supports deadlines (those through an SSH
+	// bastion don't), so we also close it when the time is up, so that a
+	// stalled server can't hold up the checks of all the others.
+	conn.SetDeadline(deadline)
+	raw := conn
+	timer := time.AfterFunc(time.Until(deadline), func() { raw.Close() })
+	defer timer.Stop()
+
+	// There's no client to speak of, so the PROXY header says so (a v2
+	// LOCAL or v1 UNKNOWN header) rather than giving our own address.
+	if ep.server.ProxyProtocol != 0 {
+		if err := writeProxyHeader(conn, ep.server.ProxyProtocol,
+			nil, nil); err != nil {
+			return 0, err
+		}
+	}
+
+	if hc.TLS && ep.UseTLS {
+		tlsConfig, err := ep.tlsClientConfig(config)
+		if err != nil {
+			return 0, err
+		}
+		// Leave recording a certificate on first use to real sessions.
+		if ep.pinned() {
+			tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+				return ep.verifyPin(config, cs.PeerCertificates[0], false)
+			}
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return 0, err
+		}
+		conn = tlsConn
+	}
+
+	if hc.Telnet {
+		if err := awaitTerminalType(conn); err != nil {
+			return 0, err
+		}
+	}
+
+	return time.Since(start), nil
+}
+
+// awaitTerminalType reads from conn until the server sends IAC DO
+// TERMINAL-TYPE.
+func awaitTerminalType(conn io.Reader) error {
+	want := []byte{telnetIAC, telnetDO, telnetTerminalType}
+	var seen []byte
+	buf := make([]byte, 256)
+	for {
+		n, err := conn.Read(buf)
+		seen = append(seen, buf[:n]...)
+		if bytes.Contains(seen, want) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("no telnet terminal type request: %v", err)
+		}
+		// Only the end of what we've seen could be the start of the
+		// request.
+		if len(seen) > len(want) {
+			seen = seen[len(seen)-len(want):]
+		}
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// telnetServer listens on a local port and sends greeting to every client
+// that connects. It returns the port.
+func telnetServer(t *testing.T, greeting []byte) uint {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write(greeting)
+			go func() {
+				time.Sleep(time.Second)
+				conn.Close()
+			}()
+		}
+	}()
+	return uint(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestHealthChecks(t *testing.T) {
+	tn3270 := telnetServer(t, []byte{telnetIAC, telnetDO, telnetTerminalType})
+	silent := telnetServer(t, []byte("login: "))
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := uint(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+
+	type TestCase struct {
+		Name     string
+		Ports    []uint
+		Expected healthStatus
+	}
+
+	testCases := []TestCase{
+		{"up", []uint{tn3270}, statusUp},
+		{"down", []uint{closed}, statusDown},
+		{"not telnet", []uint{silent}, statusDown},
+		{"degraded", []uint{closed, tn3270}, statusDegraded},
+	}
+
+	config := &Config{
+		HealthCheck: &HealthCheckConfig{Timeout: Duration(time.Second), Telnet: true},
+	}
+	for _, tc := range testCases {
+		server := ServerConfig{Name: tc.Name}
+		for _, port := range tc.Ports {
+			server.Endpoints = append(server.Endpoints,
+				EndpointConfig{Host: "127.0.0.1", Port: port})
+		}
+		config.Servers = append(config.Servers, server)
+	}
+
+	h := &healthTracker{
+		unhealthy: make(map[string]time.Time),
+		checks:    make(map[string]healthResult),
+	}
+	for i, tc := range testCases {
+		if got, _ := h.serverStatus(config, &config.Servers[i]); got != statusUnknown {
+			t.Errorf("%s before checks: got %v; we expected no status", tc.Name, got)
+		}
+	}
+	h.checkAll(config)
+	for i, tc := range testCases {
+		if got, _ := h.serverStatus(config, &config.Servers[i]); got != tc.Expected {
+			t.Errorf("%s: got %v; we expected %v", tc.Name, got, tc.Expected)
+		}
+	}
+	down := config.Servers[1].endpoints()[0]
+	if h.healthy(down.address()) {
+		t.Errorf("endpoint that is down should be unhealthy")
+	}
+	h.succeeded(down)
+	if !h.healthy(down.address()) {
+		t.Errorf("endpoint we connected to after a failed check should be healthy")
+	}
+
+	// Any latency is too slow, and servers no longer configured are
+	// forgotten.
+	config.HealthCheck.Slow = Duration(time.Nanosecond)
+	config.Servers = config.Servers[:1]
+	h.checkAll(config)
+	if got, _ := h.serverStatus(config, &config.Servers[0]); got != statusDegraded {
+		t.Errorf("slow: got %v; we expected DEGRADED", got)
+	}
+	if len(h.checks) != 1 {
+		t.Errorf("got %d results after reload; we expected 1", len(h.checks))
+	}
+}
+
+func TestHealthCheckTrustOnFirstUse(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue("mainframe.internal")
+	port := tlsServer(t, certFile, keyFile, nil)
+	config := &Config{
+		KnownServers: filepath.Join(t.TempDir(), "known_servers"),
+		HealthCheck:  &HealthCheckConfig{TLS: true},
+		Servers: []ServerConfig{{Name: "Test", EndpointConfig: EndpointConfig{
+			Host: "127.0.0.1", Port: port, UseTLS: true, TrustOnFirstUse: true}}},
+	}
+	ep := config.Servers[0].endpoints()[0]
+
+	// A check must not trust the certificate on the first session's behalf,
+	// but must notice when it differs from the one that was trusted.
+	if _, err := ep.check(config, config.HealthCheck); err != nil {
+		t.Fatalf("check before first use: unexpected error: %v", err)
+	}
+	if got, _ := knownServers.lookup(config.KnownServers, ep.address()); got != "" {
+		t.Errorf("check recorded fingerprint %s; we expected it to record nothing", got)
+	}
+	knownServers.set(config.KnownServers, ep.address(),
+		"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=")
+	var changed *certChangedError
+	if _, err := ep.check(config, config.HealthCheck); !errors.As(err, &changed) {
+		t.Errorf("check of changed certificate returned %v; we expected certChangedError", err)
+	}
+}
+
+func TestHealthCheckThroughTunnel(t *testing.T) {
+	_, tunnel, _ := newTestTunnel(t)
+	stall := stallServer(t)
+	config := &Config{
+		HealthCheck: &HealthCheckConfig{
+			Timeout: Duration(200 * time.Millisecond),
+			Telnet:  true,
+		},
+		Servers: []ServerConfig{{Name: "Test", SSH: tunnel,
+			EndpointConfig: EndpointConfig{Host: "127.0.0.1",
+				Port: uint(stall.Port)}}},
+	}
+	h := &healthTracker{
+		unhealthy: make(map[string]time.Time),
+		checks:    make(map[string]healthResult),
+	}
+
+	// The target accepts the connection but never asks for a terminal
+	// type, so the check must give up on it after the timeout.
+	done := make(chan struct{})
+	go func() {
+		h.checkAll(config)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("health check through the tunnel didn't time out")
+	}
+	if got, _ := h.serverStatus(config, &config.Servers[0]); got != statusDown {
+		t.Errorf("got %v; we expected DOWN", got)
+	}
+}
@@ -0,0 +1,331 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// KeepaliveConfig controls how we detect clients and servers that have gone
+// away without closing their connections.
+type KeepaliveConfig struct {
+	// TCP is the TCP keepalive period on both client and server
+	// connections. If zero, defaultTCPKeepalive is used.
+	TCP Duration `json:"tcp"`
+
+	// Probe, if set, is the kind of telnet probe to send to clients while
+	// they are connected to a server: "nop" or "timing-mark".
+	Probe         string   `json:"probe"`
+	ProbeInterval Duration `json:"probeInterval"`
+	ProbeTimeout  Duration `json:"probeTimeout"`
+}
+
+const (
+	// defaultTCPKeepalive is the same as the Go runtime's default, which we
+	// set explicitly so that client connections, including those accepted
+	// on inherited sockets, get the same period as server connections.
+	defaultTCPKeepalive  = 15 * time.Second
+	defaultProbeInterval = time.Minute
+	defaultProbeTimeout  = 30 * time.Second
+)
+
+func (k *KeepaliveConfig) validate() error {
+	if k == nil {
+		return nil
+	}
+	if k.TCP < 0 || k.ProbeInterval < 0 || k.ProbeTimeout < 0 {
+		return fmt.Errorf("Keepalive times must not be negative")
+	}
+	switch k.Probe {
+	case "", "nop", "timing-mark":
+	default:
+		return fmt.Errorf("Keepalive probe `%s` invalid: must be nop or timing-mark",
+			k.Probe)
+	}
+	return nil
+}
+
+func (k *KeepaliveConfig) tcpPeriod() time.Duration {
+	if k == nil || k.TCP == 0 {
+		return defaultTCPKeepalive
+	}
+	return time.Duration(k.TCP)
+}
+
+func (k *KeepaliveConfig) probeInterval() time.Duration {
+	if k.ProbeInterval == 0 {
+		return defaultProbeInterval
+	}
+	return time.Duration(k.ProbeInterval)
+}
+
+func (k *KeepaliveConfig) probeTimeout() time.Duration {
+	if k.ProbeTimeout == 0 {
+		return defaultProbeTimeout
+	}
+	return time.Duration(k.ProbeTimeout)
+}
+
+// setTCPKeepalive sets the keepalive period on a TCP connection. A period
+// of zero leaves the connection alone.
+func setTCPKeepalive(conn net.Conn, period time.Duration) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || period <= 0 {
+		return
+	}
+	tcpConn.SetKeepAlive(true)
+	tcpConn.SetKeepAlivePeriod(period)
+}
+
+// Telnet protocol bytes (RFC 854, RFC 860, and RFC 1091).
+const (
+	telnetIAC          = 255
+	telnetDONT         = 254
+	telnetDO           = 253
+	telnetWONT         = 252
+	telnetWILL         = 251
+	telnetSB           = 250
+	telnetNOP          = 241
+	telnetSE           = 240
+	telnetTimingMark   = 6
+	telnetTerminalType = 24
+)
+
+// telnetWriter serializes writes to the client, keeping track of where the
+// data stream is in the telnet protocol so that probes are only inserted
+// between complete commands, never in the middle of one that the server's
+// data happened to split across writes.
+type telnetWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	state int
+}
+
+// telnetWriter states.
+const (
+	twData   = iota
+	twIAC    // after IAC
+	twOption // after IAC and a verb that takes an option byte
+	twSB     // in a subnegotiation
+	twSBIAC  // after IAC in a subnegotiation
+)
+
+func newTelnetWriter(w io.Writer) *telnetWriter {
+	return &telnetWriter{w: w}
+}
+
+func (tw *telnetWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	n, err := tw.w.Write(p)
+	for _, b := range p[:n] {
+		switch tw.state {
+		case twData:
+			if b == telnetIAC {
+				tw.state = twIAC
+			}
+		case twIAC:
+			switch {
+			case b == telnetSB:
+				tw.state = twSB
+			case b >= telnetWILL && b <= telnetDONT:
+				tw.state = twOption
+			default:
+				tw.state = twData
+			}
+		case twOption:
+			tw.state = twData
+		case twSB:
+			if b == telnetIAC {
+				tw.state = twSBIAC
+			}
+		case twSBIAC:
+			if b == telnetSE {
+				tw.state = twData
+			} else {
+				tw.state = twSB
+			}
+		}
+	}
+	return n, err
+}
+
+// command writes a telnet command if the stream is at a point where one may
+// be inserted. It returns false if not, in which case the caller should try
+// again later.
+func (tw *telnetWriter) command(cmd ...byte) (bool, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.state != twData {
+		return false, nil
+	}
+	_, err := tw.w.Write(cmd)
+	return true, err
+}
+
+// prober sends telnet probes to the client while it is connected to a
+// server, and ends the session if a TIMING-MARK probe goes unanswered.
+type prober struct {
+	method   string
+	interval time.Duration
+	timeout  time.Duration
+	out      *telnetWriter
+
+	// Replies to our TIMING-MARK requests must be removed from the data we
+	// pass on to the server, since the server didn't ask for them.
+	mu      sync.Mutex
+	pending int
+	replied chan struct{}
+	state   int // of the client's data stream, for filter()
+	held    []byte
+}
+
+// prober filter states.
+const (
+	pfData = iota
+	pfIAC
+	pfVerb // after IAC WILL or IAC WONT
+)
+
+func newProber(k *KeepaliveConfig, out *telnetWriter) *prober {
+	if k == nil || k.Probe == "" {
+		return nil
+	}
+	return &prober{
+		method:   k.Probe,
+		interval: k.probeInterval(),
+		timeout:  k.probeTimeout(),
+		out:      out,
+		replied:  make(chan struct{}, 1),
+	}
+}
+
+// run sends probes until done is closed, or until the client fails to
+// answer one, in which case it calls dead.
+func (p *prober) run(done <-chan struct{}, dead func(reason string)) {
+	if p == nil {
+		return
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		// We count the TIMING-MARK as pending before sending it, so that
+		// the filter is ready for the reply however fast it comes.
+		timingMark := p.method == "timing-mark"
+		cmd := []byte{telnetIAC, telnetNOP}
+		if timingMark {
+			cmd = []byte{telnetIAC, telnetDO, telnetTimingMark}
+			p.expectReplies(1)
+		}
+		sent, err := p.out.command(cmd...)
+		if err != nil {
+			dead(fmt.Sprintf("keepalive probe failed: %v", err))
+			return
+		}
+		if !sent {
+			// We'll try again at the next tick.
+			if timingMark {
+				p.expectReplies(-1)
+			}
+			continue
+		}
+		if !timingMark {
+			continue
+		}
+
+		timer := time.NewTimer(p.timeout)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-p.replied:
+			timer.Stop()
+		case <-timer.C:
+			dead(fmt.Sprintf("no reply to keepalive probe in %s", p.timeout))
+			return
+		}
+	}
+}
+
+func (p *prober) expectReplies(n int) {
+	p.mu.Lock()
+	p.pending += n
+	p.mu.Unlock()
+}
+
+// filter removes replies to our TIMING-MARK probes from data read from the
+// client, returning what's left to pass on to the server. A telnet command
+// split across reads is held back until the rest of it arrives.
+func (p *prober) filter(data []byte) []byte {
+	if p == nil || p.method != "timing-mark" {
+		return data
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	in := append(p.held, data...)
+	p.held = nil
+	out := make([]byte, 0, len(in))
+	start := 0 // where the command being parsed starts
+	for i, b := range in {
+		switch p.state {
+		case pfData:
+			if b == telnetIAC {
+				p.state = pfIAC
+				start = i
+				continue
+			}
+			out = append(out, b)
+		case pfIAC:
+			if b == telnetWILL || b == telnetWONT {
+				p.state = pfVerb
+				continue
+			}
+			out = append(out, telnetIAC, b)
+			p.state = pfData
+		case pfVerb:
+			if b == telnetTimingMark && p.pending > 0 {
+				p.pending--
+				select {
+				case p.replied <- struct{}{}:
+				default:
+				}
+			} else {
+				out = append(out, in[start:i+1]...)
+			}
+			p.state = pfData
+		}
+	}
+	if p.state != pfData {
+		p.held = append([]byte{}, in[start:]...)
+		p.state = pfData
+	}
+	return out
+}
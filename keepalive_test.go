@@ -0,0 +1,124 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTCPKeepalivePeriod(t *testing.T) {
+	type TestCase struct {
+		Name     string
+		Config   *KeepaliveConfig
+		Expected time.Duration
+	}
+
+	testCases := []TestCase{
+		{"no keepalive block", nil, defaultTCPKeepalive},
+		{"tcp unset", &KeepaliveConfig{Probe: "nop"}, defaultTCPKeepalive},
+		{"tcp set", &KeepaliveConfig{TCP: Duration(time.Minute)}, time.Minute},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.Config.tcpPeriod(); got != tc.Expected {
+			t.Errorf("%s: got %s; we expected %s", tc.Name, got, tc.Expected)
+		}
+	}
+}
+
+func TestProberFilter(t *testing.T) {
+	type TestCase struct {
+		Name    string
+		Pending int
+		Reads   [][]byte
+		Output  []byte
+		Replies int
+	}
+
+	testCases := []TestCase{
+		{"no replies", 1, [][]byte{{0x7d, 0x40, 0x40, 0xff, 0xef}},
+			[]byte{0x7d, 0x40, 0x40, 0xff, 0xef}, 0},
+		{"WILL reply", 1, [][]byte{{0x7d, 0xff, 0xfb, 0x06, 0x40, 0xff, 0xef}},
+			[]byte{0x7d, 0x40, 0xff, 0xef}, 1},
+		{"WONT reply", 1, [][]byte{{0xff, 0xfc, 0x06}}, []byte{}, 1},
+		{"split reply", 1, [][]byte{{0x7d, 0xff}, {0xfb}, {0x06, 0x40}},
+			[]byte{0x7d, 0x40}, 1},
+		{"not ours", 0, [][]byte{{0xff, 0xfb, 0x06}}, []byte{0xff, 0xfb, 0x06}, 0},
+		{"one pending", 1, [][]byte{{0xff, 0xfb, 0x06, 0xff, 0xfb, 0x06}},
+			[]byte{0xff, 0xfb, 0x06}, 1},
+		{"escaped IAC", 1, [][]byte{{0xff, 0xff, 0xfb, 0x06}},
+			[]byte{0xff, 0xff, 0xfb, 0x06}, 0},
+		{"other option", 1, [][]byte{{0xff, 0xfb, 0x19}},
+			[]byte{0xff, 0xfb, 0x19}, 0},
+	}
+
+	for _, tc := range testCases {
+		p := newProber(&KeepaliveConfig{Probe: "timing-mark"}, nil)
+		p.replied = make(chan struct{}, 10)
+		p.pending = tc.Pending
+		var out []byte
+		for _, r := range tc.Reads {
+			out = append(out, p.filter(r)...)
+		}
+		if !bytes.Equal(out, tc.Output) {
+			t.Errorf("%s: got [%X]; we expected [%X]", tc.Name, out, tc.Output)
+		}
+		if len(p.replied) != tc.Replies {
+			t.Errorf("%s: got %d replies; we expected %d", tc.Name,
+				len(p.replied), tc.Replies)
+		}
+	}
+}
+
+func TestTelnetWriter(t *testing.T) {
+	type TestCase struct {
+		Name string
+		Data []byte
+		Safe bool // may a command be inserted after the data?
+	}
+
+	testCases := []TestCase{
+		{"data", []byte{0xf5, 0xc3, 0x40}, true},
+		{"end of record", []byte{0x40, 0xff, 0xef}, true},
+		{"dangling IAC", []byte{0x40, 0xff}, false},
+		{"escaped IAC", []byte{0x40, 0xff, 0xff}, true},
+		{"option verb", []byte{0xff, 0xfd}, false},
+		{"option", []byte{0xff, 0xfd, 0x18}, true},
+		{"subnegotiation", []byte{0xff, 0xfa, 0x18, 0x01}, false},
+		{"IAC in subnegotiation", []byte{0xff, 0xfa, 0x18, 0xff}, false},
+		{"end of subnegotiation", []byte{0xff, 0xfa, 0x18, 0x01, 0xff, 0xf0}, true},
+	}
+
+	for _, tc := range testCases {
+		var buf bytes.Buffer
+		tw := newTelnetWriter(&buf)
+		tw.Write(tc.Data)
+		sent, err := tw.command(telnetIAC, telnetNOP)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.Name, err)
+		}
+		if sent != tc.Safe {
+			t.Errorf("%s: command sent %v; we expected %v", tc.Name, sent,
+				tc.Safe)
+		}
+	}
+}
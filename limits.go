@@ -0,0 +1,251 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// limitSweepInterval is how often we discard the records of clients that
+// no longer have connections, strikes, or bans.
+const limitSweepInterval = time.Minute
+
+// clientRecord tracks one client IP address for the connection limits.
+type clientRecord struct {
+	active int // connections currently open
+
+	// The token bucket for the connection rate limit: tokens is the number
+	// of connections the client may make right now, as of refilled.
+	tokens   float64
+	refilled time.Time
+
+	// strikes are the times of recent misbehavior, which lead to a ban
+	// once there are enough of them within the ban window.
+	strikes []time.Time
+}
+
+// refusedBanned is the reason admit gives for refusing a banned client.
+const refusedBanned = "banned"
+
+type ban struct {
+	until  time.Time
+	reason string
+}
+
+// connLimiter enforces the connection limits in the current configuration.
+// The limits are read from the configuration on every call, so they follow
+// configuration reloads.
+type connLimiter struct {
+	mu        sync.Mutex
+	clients   map[string]*clientRecord
+	bans      map[string]ban
+	lastSweep time.Time
+}
+
+var limiter = newConnLimiter()
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{
+		clients: make(map[string]*clientRecord),
+		bans:    make(map[string]ban),
+	}
+}
+
+// clientIP returns the IP address of a connection's remote address, which
+// is what the limits are applied to.
+func clientIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// admit decides whether a new connection from ip may proceed. If it is
+// refused, the reason is returned. If it is admitted, the caller must call
+// release when the connection ends.
+func (lim *connLimiter) admit(ip string) (bool, string) {
+	return lim.admitAt(ip, currentConfig().Limits, time.Now())
+}
+
+func (lim *connLimiter) admitAt(ip string, limits *LimitsConfig, now time.Time) (bool, string) {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	lim.sweep(limits, now)
+
+	rec := lim.clients[ip]
+	if rec == nil {
+		rec = &clientRecord{refilled: now, tokens: defaultConnectionBurst}
+		if limits != nil {
+			rec.tokens = limits.burst()
+		}
+		lim.clients[ip] = rec
+	}
+
+	if limits != nil {
+		if b, ok := lim.bans[ip]; ok && now.Before(b.until) {
+			return false, refusedBanned
+		}
+
+		if limits.MaxConnectionsPerIP > 0 &&
+			rec.active >= limits.MaxConnectionsPerIP {
+			lim.strike(ip, rec, limits, now, "too many connections")
+			return false, "too many connections"
+		}
+
+		if limits.ConnectionsPerMinute > 0 {
+			rec.tokens += now.Sub(rec.refilled).Minutes() *
+				limits.ConnectionsPerMinute
+			if burst := limits.burst(); rec.tokens > burst {
+				rec.tokens = burst
+			}
+			rec.refilled = now
+			if rec.tokens < 1 {
+				lim.strike(ip, rec, limits, now, "connection rate exceeded")
+				return false, "connection rate exceeded"
+			}
+			rec.tokens--
+		}
+	}
+
+	rec.active++
+	return true, ""
+}
+
+// release records that a connection admitted by admit has ended.
+func (lim *connLimiter) release(ip string) {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	if rec := lim.clients[ip]; rec != nil && rec.active > 0 {
+		rec.active--
+	}
+}
+
+// fail records misbehavior by a client, such as a failed telnet
+// negotiation, which counts toward banning it.
+func (lim *connLimiter) fail(ip, reason string) {
+	lim.failAt(ip, reason, currentConfig().Limits, time.Now())
+}
+
+func (lim *connLimiter) failAt(ip, reason string, limits *LimitsConfig, now time.Time) {
+	if limits == nil {
+		return
+	}
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	rec := lim.clients[ip]
+	if rec == nil {
+		rec = &clientRecord{refilled: now, tokens: limits.burst()}
+		lim.clients[ip] = rec
+	}
+	lim.strike(ip, rec, limits, now, reason)
+}
+
+// strike adds a strike against ip, and bans it if it has reached the
+// threshold. lim.mu must be held.
+func (lim *connLimiter) strike(ip string, rec *clientRecord, limits *LimitsConfig, now time.Time, reason string) {
+	if limits.BanThreshold == 0 {
+		return
+	}
+	if b, ok := lim.bans[ip]; ok && now.Before(b.until) {
+		return
+	}
+
+	window := now.Add(-limits.banWindow())
+	recent := rec.strikes[:0]
+	for _, t := range rec.strikes {
+		if t.After(window) {
+			recent = append(recent, t)
+		}
+	}
+	rec.strikes = append(recent, now)
+
+	if len(rec.strikes) >= limits.BanThreshold {
+		rec.strikes = nil
+		lim.bans[ip] = ban{until: now.Add(limits.banDuration()), reason: reason}
+		l.Log(WarnLvl, "Banning %s for %s: %s", ip, limits.banDuration(),
+			reason)
+	}
+}
+
+// sweep discards expired bans and the records of clients we no longer need
+// to remember. lim.mu must be held.
+func (lim *connLimiter) sweep(limits *LimitsConfig, now time.Time) {
+	if now.Sub(lim.lastSweep) < limitSweepInterval {
+		return
+	}
+	lim.lastSweep = now
+
+	for ip, b := range lim.bans {
+		if !now.Before(b.until) {
+			l.Log(InfoLvl, "Ban on %s has expired", ip)
+			delete(lim.bans, ip)
+		}
+	}
+
+	window := defaultBanWindow
+	full := float64(defaultConnectionBurst)
+	if limits != nil {
+		window = limits.banWindow()
+		full = limits.burst()
+	}
+	for ip, rec := range lim.clients {
+		if rec.active > 0 {
+			continue
+		}
+		if n := len(rec.strikes); n > 0 && now.Sub(rec.strikes[n-1]) < window {
+			continue
+		}
+		if limits != nil && limits.ConnectionsPerMinute > 0 &&
+			rec.tokens+now.Sub(rec.refilled).Minutes()*
+				limits.ConnectionsPerMinute < full {
+			continue
+		}
+		delete(lim.clients, ip)
+	}
+}
+
+// logBans writes the list of currently banned addresses to the log.
+func (lim *connLimiter) logBans() {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+
+	now := time.Now()
+	var ips []string
+	for ip, b := range lim.bans {
+		if now.Before(b.until) {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+
+	l.Log(InfoLvl, "%d addresses banned", len(ips))
+	for _, ip := range ips {
+		b := lim.bans[ip]
+		l.Log(InfoLvl, "  %s until %s: %s", ip,
+			b.until.Format(time.RFC3339), b.reason)
+	}
+}
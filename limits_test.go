@@ -0,0 +1,131 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestConnLimiter(t *testing.T) {
+	limits := &LimitsConfig{
+		MaxConnectionsPerIP:  2,
+		ConnectionsPerMinute: 6,
+		ConnectionBurst:      3,
+		BanThreshold:         3,
+		BanWindow:            Duration(time.Minute),
+		BanDuration:          Duration(time.Hour),
+	}
+	lim := newConnLimiter()
+	start := time.Now()
+	const ip = "192.0.2.10"
+
+	type step struct {
+		Name    string
+		At      time.Duration // since start
+		Release bool          // release a connection instead of admitting one
+		Admit   bool
+	}
+
+	steps := []step{
+		{"first", 0, false, true},
+		{"second", 0, false, true},
+		{"over the cap", 0, false, false}, // strike 1
+		{"release", 0, true, false},
+		{"last of the burst", 0, false, true},
+		{"release", 0, true, false},
+		{"burst used up", 0, false, false}, // strike 2
+		{"refilled", 10 * time.Second, false, true},
+		{"release", 10 * time.Second, true, false},
+		{"rate exceeded", 11 * time.Second, false, false}, // strike 3: banned
+		{"banned", 5 * time.Minute, false, false},
+		{"ban expired", 61 * time.Minute, false, true},
+	}
+
+	for _, s := range steps {
+		if s.Release {
+			lim.release(ip)
+			continue
+		}
+		ok, reason := lim.admitAt(ip, limits, start.Add(s.At))
+		if ok != s.Admit {
+			t.Errorf("%s: admitted %v (%s); we expected %v", s.Name, ok,
+				reason, s.Admit)
+		}
+	}
+
+	if ok, _ := lim.admitAt("192.0.2.11", limits, start.Add(5*time.Minute)); !ok {
+		t.Errorf("a different address should not be affected by the ban")
+	}
+
+	// Strikes that are spread out beyond the ban window don't add up.
+	for i := 0; i < 5; i++ {
+		lim.failAt("192.0.2.12", "testing", limits,
+			start.Add(time.Duration(i)*45*time.Second))
+	}
+	if ok, _ := lim.admitAt("192.0.2.12", limits, start.Add(4*time.Minute)); !ok {
+		t.Errorf("strikes outside the ban window should not cause a ban")
+	}
+
+	// Without limits, everything is admitted.
+	lim = newConnLimiter()
+	for i := 0; i < 100; i++ {
+		if ok, _ := lim.admitAt(ip, nil, start); !ok {
+			t.Fatalf("connection %d refused without limits configured", i)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	type TestCase struct {
+		JSON     string
+		Expected time.Duration
+		Err      bool
+	}
+
+	testCases := []TestCase{
+		{`"90s"`, 90 * time.Second, false},
+		{`"1h30m"`, 90 * time.Minute, false},
+		{`45`, 45 * time.Second, false},
+		{`0.5`, 500 * time.Millisecond, false},
+		{`"soon"`, 0, true},
+		{`true`, 0, true},
+	}
+
+	for _, tc := range testCases {
+		var d Duration
+		err := json.Unmarshal([]byte(tc.JSON), &d)
+		if tc.Err {
+			if err == nil {
+				t.Errorf("%s: expected an error but got none", tc.JSON)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.JSON, err)
+			continue
+		}
+		if time.Duration(d) != tc.Expected {
+			t.Errorf("%s: got %s; we expected %s", tc.JSON, time.Duration(d),
+				tc.Expected)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// listener is a socket we accept client connections on, along with the
+// settings that control how connections arriving on it are prepared before
+// they are handed to handle().
+type listener struct {
+	ln net.Listener
+
+	// addr is the configured bind address of the listener, which we use to
+	// look up the listener's menu settings in the current configuration.
+	addr string
+
+	// kind describes connections from this listener in log messages, e.g.
+	// "TLS ". It is blank for plain listeners.
+	kind string
+
+	// tlsConfig is non-nil if clients must connect with TLS, in which case
+	// certs holds the listener's certificates.
+	tlsConfig *tls.Config
+	certs     *certStore
+
+	// If proxyProtocol is true, connections from addresses in
+	// proxyTrusted must begin with a PROXY protocol header. Connections from
+	// other addresses are treated as direct client connections.
+	proxyProtocol bool
+	proxyTrusted  []*net.IPNet
+
+	// clientIdentity selects which part of a client certificate identifies
+	// the user, when client certificates are in use.
+	clientIdentity string
+}
+
+// startListeners opens a socket for each of the listener configurations,
+// applying the global TLS policy to any TLS listeners that don't override
+// it. If any of them can't be started, the ones already opened are closed
+// again.
+func startListeners(configs []ListenerConfig, policy *TLSPolicy) ([]*listener, error) {
+	var listeners []*listener
+	for i := range configs {
+		lsn, err := startListener(&configs[i], policy)
+		if err != nil {
+			for _, lsn := range listeners {
+				lsn.ln.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, lsn)
+	}
+	return listeners, nil
+}
+
+func startListener(lc *ListenerConfig, policy *TLSPolicy) (*listener, error) {
+	lsn := &listener{addr: lc.addr(), proxyProtocol: lc.ProxyProtocol}
+
+	var err error
+	lsn.proxyTrusted, err = parseCIDRList(lc.ProxyProtocolTrusted)
+	if err != nil {
+		return nil, err
+	}
+
+	if pairs := lc.certificatePairs(); len(pairs) > 0 {
+		lsn.certs, err = newCertStore(pairs)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %v", lsn.addr, err)
+		}
+		lsn.kind = "TLS "
+		lsn.tlsConfig = &tls.Config{GetCertificate: lsn.certs.getCertificate}
+		if err := policy.merge(lc.TLS).apply(lsn.tlsConfig); err != nil {
+			return nil, fmt.Errorf("listener %s: %v", lsn.addr, err)
+		}
+
+		if lc.ClientCA != "" {
+			pool, err := loadCertPool(lc.ClientCA)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't load client CA for %s: %v",
+					lsn.addr, err)
+			}
+			lsn.tlsConfig.ClientCAs = pool
+			lsn.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			if lc.RequireClientCert {
+				lsn.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			lsn.clientIdentity = lc.ClientIdentity
+		}
+	}
+
+	// The TLS handshake happens after we accept each connection, since
+	// there may be a PROXY protocol header in front of it, so the socket
+	// itself is always a plain TCP listener.
+	if lsn.ln = takeInheritedListener(lsn.addr); lsn.ln != nil {
+		l.Log(InfoLvl, "LISTENING ON INHERITED SOCKET %s FOR %sCONNECTIONS",
+			lsn.ln.Addr(), lsn.kind)
+		return lsn, nil
+	}
+	lsn.ln, err = net.Listen("tcp", lsn.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l.Log(InfoLvl, "LISTENING ON %s FOR %sCONNECTIONS", lsn.ln.Addr(),
+		lsn.kind)
+	return lsn, nil
+}
+
+// serve accepts connections until the listener is closed, preparing and
+// handling each one in a new goroutine.
+func (lsn *listener) serve(timeout int, unnegotiate bool) {
+	for {
+		conn, err := lsn.ln.Accept()
+		if err != nil {
+			if !sessions.isAccepting() {
+				return
+			}
+			l.LogWithErr(ErrorLvl, err, "Couldn't accept %sconnection",
+				lsn.kind)
+			continue
+		}
+		setTCPKeepalive(conn, currentConfig().Keepalive.tcpPeriod())
+
+		// Without a PROXY header the client address is already known, so
+		// we can turn away refused clients before starting a goroutine for
+		// them. Otherwise handleConn admits the client once it has read the
+		// header.
+		var ip string
+		if !lsn.hasProxyHeader(conn) {
+			var ok bool
+			if ip, ok = lsn.admit(conn); !ok {
+				conn.Close()
+				continue
+			}
+		}
+
+		s := sessions.register(conn)
+		if s == nil {
+			if ip != "" {
+				limiter.release(ip)
+			}
+			conn.Close()
+			return
+		}
+		go lsn.handleConn(conn, s, ip, timeout, unnegotiate)
+	}
+}
+
+// hasProxyHeader reports whether a connection is expected to start with a
+// PROXY protocol header.
+func (lsn *listener) hasProxyHeader(conn net.Conn) bool {
+	return lsn.proxyProtocol && addrInNets(conn.RemoteAddr(), lsn.proxyTrusted)
+}
+
+// admit checks the connection's client against the connection limits,
+// logging the reason if it's refused. It returns the client IP, which must
+// be passed to limiter.release when the connection ends if it was admitted.
+func (lsn *listener) admit(conn net.Conn) (string, bool) {
+	ip := clientIP(conn.RemoteAddr())
+	if ok, reason := limiter.admit(ip); !ok {
+		// Banned clients may keep trying for a long time, so we don't
+		// fill the log with them.
+		lvl := InfoLvl
+		if reason == refusedBanned {
+			lvl = DebugLvl
+		}
+		l.Log(lvl, "Refused %sconnection from %s: %s", lsn.kind,
+			conn.RemoteAddr(), reason)
+		return ip, false
+	}
+	return ip, true
+}
+
+// handleConn strips the PROXY protocol header and sets up TLS as configured
+// for the listener, then passes the connection on to handle(). ip is the
+// client IP if serve has already admitted the client, or blank if it's still
+// to be admitted once the PROXY header is read.
+func (lsn *listener) handleConn(conn net.Conn, s *activeSession, ip string, timeout int, unnegotiate bool) {
+	drop := func() {
+		conn.Close()
+		sessions.unregister(s)
+	}
+	if ip != "" {
+		defer limiter.release(ip)
+	}
+
+	if lsn.hasProxyHeader(conn) {
+		pconn, err := readProxyHeader(conn)
+		if err != nil {
+			l.LogWithErr(ErrorLvl, err,
+				"Couldn't read PROXY protocol header from %s",
+				conn.RemoteAddr())
+			drop()
+			return
+		}
+		l.Log(DebugLvl, "PROXY protocol connection via %s for %s",
+			conn.RemoteAddr(), pconn.RemoteAddr())
+		conn = pconn
+	}
+
+	if sessions.isShuttingDown() {
+		drop()
+		return
+	}
+
+	if ip == "" {
+		var ok bool
+		if ip, ok = lsn.admit(conn); !ok {
+			drop()
+			return
+		}
+		defer limiter.release(ip)
+	}
+
+	s.listenAddr = lsn.addr
+
+	var tlsInfo string
+	if lsn.tlsConfig != nil {
+		tlsConn := tls.Server(conn, lsn.tlsConfig)
+		conn = tlsConn
+
+		// We perform the handshake now, rather than letting it happen on
+		// the first read, so we know who the client is before going on.
+		timeout := time.Duration(currentConfig().timeouts(nil).TLSHandshake)
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		err := tlsConn.Handshake()
+		tlsConn.SetDeadline(time.Time{})
+		if isTimeout(err) {
+			l.Log(WarnLvl, "TLS handshake timed out for %s after %s",
+				conn.RemoteAddr(), timeout)
+			limiter.fail(ip, "TLS handshake timed out")
+			drop()
+			return
+		} else if err != nil {
+			l.LogWithErr(ErrorLvl, err, "TLS handshake failed for %s",
+				conn.RemoteAddr())
+			limiter.fail(ip, "TLS handshake failed")
+			drop()
+			return
+		}
+
+		state := tlsConn.ConnectionState()
+		tlsInfo = describeTLS(state)
+		if len(state.PeerCertificates) > 0 {
+			s.identity = certIdentity(state.PeerCertificates[0],
+				lsn.clientIdentity)
+		}
+	}
+
+	sessions.setConn(s, conn)
+	if tlsInfo != "" {
+		l.Log(InfoLvl, "New %sconnection from %s (%s)", lsn.kind,
+			s.clientName(), tlsInfo)
+	} else {
+		l.Log(InfoLvl, "New %sconnection from %s", lsn.kind, s.clientName())
+	}
+	handle(conn, s, timeout, unnegotiate)
+}
+
+// loadCertPool reads a bundle of PEM-encoded CA certificates.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// certIdentity returns the user identity from a verified client
+// certificate, using the certificate field selected by source: "cn" (the
+// subject common name, which is the default), "email", "dns", or "uri" (the
+// first subject alternative name of that type). It returns a blank string if
+// the certificate doesn't have the requested field.
+func certIdentity(cert *x509.Certificate, source string) string {
+	switch source {
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+	return ""
+}
@@ -20,7 +20,7 @@
 package main
 
 import (
-	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -29,6 +29,7 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/racingmars/go3270"
@@ -43,8 +44,6 @@ type userSession struct {
 
 const errFieldName = "errmessage"
 
-var config *Config
-
 var l *Logger
 
 func init() {
@@ -62,10 +61,17 @@ func main() {
 	pubkey := flag.String("pubkey", "pubkey.pem", "public certificate and bundle (PEM)")
 	privkey := flag.String("privkey", "privkey.pem", "private key (PEM)")
 	tlsenable := flag.Bool("tlsenable", false, "Enable TLS listener?")
+	clientCA := flag.String("clientCA", "", "CA certificate bundle (PEM) to verify required client certificates on the TLS listener")
+	proxyProtocol := flag.Bool("proxyProtocol", false, "expect a PROXY protocol header on unencrypted connections from trusted load balancers")
+	tlsProxyProtocol := flag.Bool("tlsProxyProtocol", false, "expect a PROXY protocol header on TLS connections from trusted load balancers")
+	proxyTrusted := flag.String("proxyProtocolTrusted", "", "comma-separated list of load balancer addresses or CIDR blocks that PROXY protocol headers are accepted from")
 	configFile := flag.String("config", "config.json", "configuration file path")
 	unnegotiate := flag.Bool("unnegotiate", false, "Attempt to un-negotiate the 3270 telnet options before handing the client to the selected target host")
 	telnetTimeout := flag.Int("telnetTimeout", 1, "length of time to wait for telnet command response from clients when un-negotiating the 3270 session")
 	logFile := flag.String("log", "", "log file name to enable logging to a file")
+	watchInterval := flag.Int("watchConfig", 0, "if non-zero, check the config file for changes every this many seconds and reload it")
+	shutdownGrace := flag.Int("shutdownGrace", 30, "length of time, in seconds, to let active proxied sessions continue after a shutdown signal before closing them")
+	acceptCert := flag.String("acceptCert", "", "connect to the named server, trust the certificate it presents in place of the one recorded on first use, and exit")
 	flag.Parse()
 
 	if *trace {
@@ -96,7 +102,17 @@ func main() {
 		return
 	}
 
-	config, err = loadConfig(*configFile)
+	if *shutdownGrace < 0 {
+		l.Log(ErrorLvl, "shutdownGrace must not be negative")
+		return
+	}
+
+	if *watchInterval < 0 {
+		l.Log(ErrorLvl, "watchConfig must not be negative")
+		return
+	}
+
+	config, err := loadConfig(*configFile)
 	if err != nil {
 		l.LogWithErr(ErrorLvl, err, "Couldn't load config file")
 		return
@@ -107,71 +123,181 @@ func main() {
 		l.LogWithErr(ErrorLvl, err, "Config error")
 		return
 	}
+	setConfig(config)
 
-	var tlsln net.Listener
-	if *tlsenable {
-		cert, err := tls.LoadX509KeyPair(*pubkey, *privkey)
-		if err != nil {
-			l.LogWithErr(ErrorLvl, err, "Couldn't load X.509 certificate")
-			return
+	if *acceptCert != "" {
+		if err := acceptServerCert(config, *acceptCert); err != nil {
+			l.LogWithErr(ErrorLvl, err, "Couldn't accept certificate for `%s`",
+				*acceptCert)
 		}
+		return
+	}
 
-		certConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
-		tlsln, err = tls.Listen("tcp", ":"+strconv.Itoa(*tlsport), certConfig)
-		if err != nil {
-			l.LogWithErr(ErrorLvl, err, "Couldn't start TLS listener")
+	go runHealthChecks()
+
+	if *watchInterval > 0 {
+		go watchConfig(*configFile, time.Duration(*watchInterval)*time.Second)
+	}
+
+	// Listeners in the config file take precedence; otherwise we listen
+	// as directed by the command line flags.
+	listenerConfigs := config.Listeners
+	if len(listenerConfigs) == 0 {
+		var trusted []string
+		if *proxyTrusted != "" {
+			trusted = strings.Split(*proxyTrusted, ",")
+		}
+		if (*proxyProtocol || *tlsProxyProtocol) && len(trusted) == 0 {
+			l.Log(ErrorLvl, "PROXY protocol requires at least one proxyProtocolTrusted address")
 			return
 		}
+		listenerConfigs = append(listenerConfigs, ListenerConfig{
+			Port:                 uint(*port),
+			ProxyProtocol:        *proxyProtocol,
+			ProxyProtocolTrusted: trusted,
+		})
+		if *tlsenable {
+			listenerConfigs = append(listenerConfigs, ListenerConfig{
+				Port:                 uint(*tlsport),
+				Certificate:          *pubkey,
+				Key:                  *privkey,
+				ClientCA:             *clientCA,
+				RequireClientCert:    *clientCA != "",
+				ProxyProtocol:        *tlsProxyProtocol,
+				ProxyProtocolTrusted: trusted,
+			})
+		}
 	}
 
-	ln, err := net.Listen("tcp", ":"+strconv.Itoa(*port))
-	if err != nil {
-		l.LogWithErr(ErrorLvl, err, "Couldn't start unencrypted listener")
+	// We may have been passed listening sockets by systemd or by the
+	// previous proxy3270 process during an upgrade.
+	if err := loadInheritedListeners(); err != nil {
+		l.LogWithErr(ErrorLvl, err, "Couldn't use inherited listening sockets")
 		return
 	}
-	l.Log(InfoLvl, "LISTENING ON PORT %d FOR CONNECTIONS", *port)
-	if *tlsenable {
-		l.Log(InfoLvl, "LISTENING ON PORT %d FOR TLS CONNECTIONS", *tlsport)
+
+	listeners, err := startListeners(listenerConfigs, config.TLS)
+	if err != nil {
+		l.LogWithErr(ErrorLvl, err, "Couldn't start listener")
+		return
 	}
+	closeUnclaimedListeners()
+	notifyUpgradeReady()
 	l.Log(InfoLvl, "Press Ctrl-C to end server.")
 
-	// Run the accept loop in a goroutine so we can wait on the quit signal
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				l.LogWithErr(ErrorLvl, err, "Couldn't accept connection")
-			}
-			l.Log(InfoLvl, "New connection from %s", conn.RemoteAddr())
-			go handle(conn, *telnetTimeout, *unnegotiate)
-		}
-	}()
-
-	// Run the accept loop in a goroutine so we can wait on the quit signal
-	if *tlsenable {
-		go func() {
-			for {
-				conn, err := tlsln.Accept()
-				if err != nil {
-					l.LogWithErr(ErrorLvl, err, "Couldn't accept TLS connection")
+	// Run the accept loops in goroutines so we can wait on the quit signal
+	for _, lsn := range listeners {
+		go lsn.serve(*telnetTimeout, *unnegotiate)
+		if lsn.certs != nil {
+			go lsn.certs.watch(certCheckInterval)
+		}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	if upgradeSignal != nil {
+		signal.Notify(sigs, upgradeSignal, statusSignal)
+	}
+
+	// After handing our listeners off to a new process, we wait for our
+	// remaining sessions to end on their own, and then quit. drained stays
+	// nil (and so never ready) until then.
+	var drained <-chan struct{}
+waitloop:
+	for {
+		select {
+		case sig := <-sigs:
+			switch sig {
+			case syscall.SIGHUP:
+				l.Log(InfoLvl, "Hangup signal received: reloading configuration and certificates.")
+				reloadConfig(*configFile)
+				for _, lsn := range listeners {
+					if lsn.certs != nil {
+						lsn.certs.reload(true)
+					}
+				}
+			case statusSignal:
+				limiter.logBans()
+			case upgradeSignal:
+				if drained != nil {
+					l.Log(WarnLvl, "Listeners already handed off; ignoring upgrade signal")
+					continue
+				}
+				l.Log(InfoLvl, "Upgrade signal received: handing off listeners to a new process.")
+				if err := handoffListeners(listeners); err != nil {
+					l.LogWithErr(ErrorLvl, err, "Upgrade failed; continuing to serve")
+					continue
 				}
-				l.Log(InfoLvl, "New TLS connection from %s", conn.RemoteAddr())
-				go handle(conn, *telnetTimeout, *unnegotiate)
+				sessions.stopAccepting()
+				for _, lsn := range listeners {
+					lsn.ln.Close()
+				}
+				drained = sessions.drainedChan()
+				l.Log(InfoLvl, "New process has taken over; waiting for existing sessions to end")
+			default:
+				l.Log(InfoLvl, "Signal received (%v): shutting down.", sig)
+				break waitloop
 			}
-		}()
+		case <-drained:
+			l.Log(InfoLvl, "All sessions ended after handoff: quitting.")
+			return
+		}
 	}
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
-	<-quit
-	l.Log(InfoLvl, "Interrupt signal received: quitting.")
+	// Stop taking new connections, send everyone still at the menu on their
+	// way, and give the proxied sessions a chance to finish.
+	sessions.beginShutdown()
+	for _, lsn := range listeners {
+		lsn.ln.Close()
+	}
+	l.Log(InfoLvl, "Waiting up to %d seconds for active sessions to end",
+		*shutdownGrace)
+	if n := sessions.drain(time.Duration(*shutdownGrace) * time.Second); n > 0 {
+		l.Log(WarnLvl, "Shutdown grace period expired: closed %d active sessions", n)
+	} else {
+		l.Log(InfoLvl, "All sessions ended")
+	}
 }
 
-func handle(conn net.Conn, timeout int, unnegotiate bool) {
+func handle(conn net.Conn, s *activeSession, timeout int, unnegotiate bool) {
+	defer sessions.unregister(s)
 	defer conn.Close()
+
+	// We check the network access list before negotiating, but still
+	// negotiate with denied clients so they can be told why they aren't
+	// getting in.
+	denied := !currentConfig().allowsAddr(conn.RemoteAddr())
+	if denied {
+		l.Log(WarnLvl, "Denied access to %s by network access list",
+			s.clientName())
+	}
+
+	negotiationTimeout := time.Duration(currentConfig().timeouts(nil).Negotiation)
+	conn.SetDeadline(time.Now().Add(negotiationTimeout))
 	devinfo, err := go3270.NegotiateTelnet(conn)
+	conn.SetDeadline(time.Time{})
 	if err != nil {
-		l.LogWithErr(ErrorLvl, err, "couldn't negotiate connection from %s", conn.RemoteAddr())
+		if sessions.isShuttingDown() {
+			return
+		}
+		if isTimeout(err) {
+			l.Log(WarnLvl, "Telnet negotiation timed out for %s after %s",
+				s.clientName(), negotiationTimeout)
+			limiter.fail(clientIP(conn.RemoteAddr()), "telnet negotiation timed out")
+			return
+		}
+		l.LogWithErr(ErrorLvl, err, "couldn't negotiate connection from %s", s.clientName())
+		limiter.fail(clientIP(conn.RemoteAddr()), "telnet negotiation failed")
+		return
+	}
+
+	if denied {
+		showAccessDeniedScreen(conn, devinfo)
+		return
+	}
+
+	if !sessions.setState(s, stateMenu) {
+		showShutdownScreen(conn, devinfo)
 		return
 	}
 
@@ -180,15 +306,146 @@ func handle(conn net.Conn, timeout int, unnegotiate bool) {
 		devinfo:  devinfo,
 		pagesize: rows - 12,
 	}
-	session.totalPages = len(config.Servers) / session.pagesize
-	if session.totalPages*session.pagesize < len(config.Servers) {
-		session.totalPages++
+
+	// The user may go back to the menu from the queue screen if the server
+	// they picked is busy.
+	var config *Config
+	var selection int
+	var sl *slot
+	for sl == nil {
+		var ok bool
+		config, selection, ok = showMenu(conn, s, session)
+		if !ok {
+			return
+		}
+
+		// Rather than have the user wait out the dial timeout, tell them
+		// up front if the health checks say the server is down, or if its
+		// circuit breaker is open.
+		target := &config.Servers[selection]
+		var reason string
+		if status, _ := endpointHealth.serverStatus(config, target); status == statusDown {
+			reason = "This server is not responding. Please try again later."
+		} else if ok, wait := breakers.allow(config, target); !ok {
+			l.Log(InfoLvl, "Turning client %s away from server `%s`: circuit breaker is open",
+				s.clientName(), target.Name)
+			reason = breakerMessage(wait)
+		}
+		if reason != "" {
+			err := showUnavailableScreen(conn, session.devinfo, target.Name, reason)
+			if err != nil && sessions.isShuttingDown() {
+				l.Log(InfoLvl, "Disconnecting client %s at menu for shutdown", s.clientName())
+				showShutdownScreen(conn, session.devinfo)
+				return
+			} else if err != nil {
+				l.LogWithErr(ErrorLvl, err, "couldn't handle server unavailable screen for %s", s.clientName())
+				return
+			}
+			continue
+		}
+
+		var err error
+		sl, err = waitForSlot(conn, session.devinfo, s,
+			&config.Servers[selection])
+		if err != nil && sessions.isShuttingDown() {
+			l.Log(InfoLvl, "Disconnecting client %s in queue for shutdown", s.clientName())
+			showShutdownScreen(conn, session.devinfo)
+			return
+		} else if err != nil {
+			l.LogWithErr(ErrorLvl, err, "couldn't handle queue screen for %s", s.clientName())
+			return
+		}
+	}
+	defer slots.release(sl)
+
+	name := config.Servers[selection].Name
+
+	// Once we're proxying, a shutdown will give the session its grace period
+	// rather than ending it immediately.
+	if !sessions.setState(s, stateProxying) {
+		showShutdownScreen(conn, session.devinfo)
+		return
+	}
+
+	if unnegotiate {
+		if err := go3270.UnNegotiateTelnet(conn,
+			time.Second*time.Duration(timeout)); err != nil {
+			l.LogWithErr(ErrorLvl, err, "Couldn't unnegotiate client")
+			return
+		}
+	}
+
+	l.Log(InfoLvl, "Connecting client %s to server `%s`", s.clientName(), name)
+	var changed *certChangedError
+	if err := proxy(conn, s, config, &config.Servers[selection]); errors.As(err, &changed) {
+		l.LogWithErr(ErrorLvl, err, "Refusing connection to `%s`; if the change is expected, run proxy3270 with -acceptCert to trust the new certificate",
+			name)
+		if !unnegotiate {
+			showCertChangedScreen(conn, session.devinfo, name)
+		}
+	} else if err != nil {
+		l.LogWithErr(ErrorLvl, err, "Error proxying to `%s`", name)
+	}
+	if reason := sessions.endReason(s); reason != "" {
+		l.Log(InfoLvl, "Client %s session ended: %s", s.clientName(), reason)
+	} else {
+		l.Log(InfoLvl, "Client %s session ended", s.clientName())
 	}
+}
 
+// showMenu presents the server selection menu until the user picks a
+// server, returning the configuration snapshot they were shown and the
+// index of their selection in its server list. It returns false if the user
+// quit or the session otherwise ended.
+func showMenu(conn net.Conn, s *activeSession, session *userSession) (*Config, int, bool) {
+	// The configuration may be reloaded while the user is sitting at the
+	// menu, so we take a fresh snapshot each time we draw the screen and
+	// interpret the user's selection against the snapshot they were shown.
+	var config *Config
 	var response go3270.Response
 	var errmsg string
+
+	// A shutdown interrupts the menu by setting a read deadline, which we
+	// would overwrite when we set or clear our own, so we check for a
+	// shutdown after each time we do.
+	shutdown := func() bool {
+		if !sessions.isShuttingDown() {
+			return false
+		}
+		l.Log(InfoLvl, "Disconnecting client %s at menu for shutdown", s.clientName())
+		showShutdownScreen(conn, session.devinfo)
+		return true
+	}
+
 	for {
+		if shutdown() {
+			return nil, 0, false
+		}
+		config = currentConfig().menu(s.listenAddr).
+			forIdentity(s.identity).forAddr(conn.RemoteAddr())
+		session.totalPages = len(config.Servers) / session.pagesize
+		if session.totalPages*session.pagesize < len(config.Servers) {
+			session.totalPages++
+		}
+		if session.page > session.totalPages-1 {
+			session.page = session.totalPages - 1
+		}
+		if session.page < 0 {
+			session.page = 0
+		}
+
 		screen, rules := buildScreen(config, session)
+		// If there's an idle warning, the menu times out early and the
+		// warning screen takes up the rest of the idle time.
+		timeouts := config.timeouts(nil)
+		menuIdle := time.Duration(timeouts.MenuIdle)
+		idleWarning := time.Duration(timeouts.MenuIdleWarning)
+		if menuIdle > 0 {
+			conn.SetReadDeadline(time.Now().Add(menuIdle - idleWarning))
+			if shutdown() {
+				return nil, 0, false
+			}
+		}
 		var err error
 		response, err = go3270.HandleScreenAlt(screen, rules,
 			map[string]string{errFieldName: errmsg},
@@ -196,14 +453,38 @@ func handle(conn net.Conn, timeout int, unnegotiate bool) {
 				go3270.AIDPF7, go3270.AIDPF8},
 			errFieldName, 2, 33, conn, session.devinfo,
 			session.devinfo.Codepage())
-		if err != nil {
-			l.LogWithErr(ErrorLvl, err, "couldn't handle screen for %s", conn.RemoteAddr())
-			return
+		if err != nil && shutdown() {
+			return nil, 0, false
+		} else if err != nil && isTimeout(err) {
+			if idleWarning > 0 {
+				stay, err := showIdleWarning(conn, session.devinfo, idleWarning)
+				if err != nil && shutdown() {
+					return nil, 0, false
+				} else if err != nil {
+					l.LogWithErr(ErrorLvl, err, "couldn't handle idle warning screen for %s", s.clientName())
+					return nil, 0, false
+				}
+				if stay {
+					conn.SetReadDeadline(time.Time{})
+					continue
+				}
+			}
+			l.Log(InfoLvl, "Disconnecting client %s idle at menu for %s",
+				s.clientName(), menuIdle)
+			showIdleGoodbyeScreen(conn, session.devinfo)
+			return nil, 0, false
+		} else if err != nil {
+			l.LogWithErr(ErrorLvl, err, "couldn't handle screen for %s", s.clientName())
+			return nil, 0, false
+		}
+		conn.SetReadDeadline(time.Time{})
+		if shutdown() {
+			return nil, 0, false
 		}
 		errmsg = ""
 		switch response.AID {
 		case go3270.AIDPF3:
-			return
+			return nil, 0, false
 		case go3270.AIDPF7:
 			// page up
 			if session.page <= 0 {
@@ -231,25 +512,7 @@ func handle(conn net.Conn, timeout int, unnegotiate bool) {
 		break
 	}
 	selection, _ := strconv.Atoi(response.Values["input"])
-	selection = selection - 1
-	remote := fmt.Sprintf("%s:%d", config.Servers[selection].Host,
-		config.Servers[selection].Port)
-
-	if unnegotiate {
-		if err := go3270.UnNegotiateTelnet(conn,
-			time.Second*time.Duration(timeout)); err != nil {
-			l.LogWithErr(ErrorLvl, err, "Couldn't unnegotiate client")
-			return
-		}
-	}
-
-	l.Log(InfoLvl, "Connecting client %s to server %s", conn.RemoteAddr(), remote)
-	if err := proxy(conn, config.Servers[selection].Host,
-		config.Servers[selection].Port, config.Servers[selection].UseTLS,
-		config.Servers[selection].IgnoreCertValidation); err != nil {
-		l.LogWithErr(ErrorLvl, err, "Error proxying to %s", remote)
-	}
-	l.Log(InfoLvl, "Client %s session ended", conn.RemoteAddr())
+	return config, selection - 1, true
 }
 
 func buildScreen(config *Config, session *userSession) (go3270.Screen, go3270.Rules) {
@@ -286,8 +549,27 @@ func buildScreen(config *Config, session *userSession) (go3270.Screen, go3270.Ru
 		screen = append(screen, go3270.Field{Row: rowBase + i, Col: 2,
 			Content: fmt.Sprintf("%3d", session.page*session.pagesize+i+1),
 			Intense: true})
+		server := &config.Servers[session.page*session.pagesize+i]
+		name := server.Name
+
+		// With health checks on, each server's status goes in a column on
+		// the right, and long names are cut short to make room for it.
+		var status healthStatus
+		var latency time.Duration
+		statusCol := cols - 16
+		if config.HealthCheck != nil {
+			if len(name) > statusCol-7 {
+				name = name[:statusCol-7]
+			}
+			status, latency = endpointHealth.serverStatus(config, server)
+		}
+
 		screen = append(screen, go3270.Field{Row: rowBase + i, Col: 6,
-			Content: config.Servers[session.page*session.pagesize+i].Name})
+			Content: name})
+		if status != statusUnknown {
+			screen = append(screen, statusField(rowBase+i, statusCol, status,
+				latency))
+		}
 	}
 
 	v := func(input string) bool {
@@ -303,6 +585,175 @@ func buildScreen(config *Config, session *userSession) (go3270.Screen, go3270.Ru
 	return screen, rules
 }
 
+// statusField shows a server's health check status on the menu.
+func statusField(row, col int, status healthStatus, latency time.Duration) go3270.Field {
+	field := go3270.Field{Row: row, Col: col, Content: status.String()}
+	switch status {
+	case statusUp:
+		field.Color = go3270.Green
+	case statusDegraded:
+		field.Color = go3270.Yellow
+	case statusDown:
+		field.Color = go3270.Red
+		return field
+	}
+	if latency < 10*time.Second {
+		field.Content += fmt.Sprintf(" %dms", latency.Milliseconds())
+	} else {
+		field.Content += fmt.Sprintf(" %ds", int(latency.Seconds()))
+	}
+	return field
+}
+
+// showUnavailableScreen tells the user that the server they picked can't
+// be connected to right now, and why, and waits briefly for them to press a
+// key to go back to the menu.
+func showUnavailableScreen(conn net.Conn, devinfo go3270.DevInfo, name, reason string) error {
+	screen := go3270.Screen{
+		{Row: 0, Col: 0, Intense: true, Color: go3270.Red,
+			Content: "Server unavailable:"},
+		{Row: 1, Col: 0, Intense: true, Content: name},
+		{Row: 3, Col: 0, Content: reason},
+		{Row: 5, Col: 0, Content: "Press ENTER to return to the menu."},
+	}
+	conn.SetReadDeadline(time.Now().Add(errorScreenLinger))
+	_, err := go3270.ShowScreenOpts(screen, nil, conn, go3270.ScreenOpts{
+		AltScreen: devinfo,
+		Codepage:  devinfo.Codepage(),
+	})
+
+	// Clear our deadline before checking for a shutdown, so we can't wipe
+	// out the one a shutdown sets to interrupt the menu.
+	conn.SetReadDeadline(time.Time{})
+	if sessions.isShuttingDown() {
+		return fmt.Errorf("shutting down")
+	}
+	if err != nil && isTimeout(err) {
+		return nil
+	}
+	return err
+}
+
+// showShutdownScreen tells the user that the server is going away. The
+// caller is expected to close the connection afterward.
+func showShutdownScreen(conn net.Conn, devinfo go3270.DevInfo) {
+	screen := go3270.Screen{
+		{Row: 0, Col: 0, Intense: true, Color: go3270.Red,
+			Content: "The system is shutting down."},
+		{Row: 2, Col: 0, Content: "Please try again later."},
+	}
+	go3270.ShowScreenOpts(screen, nil, conn, go3270.ScreenOpts{
+		AltScreen:  devinfo,
+		Codepage:   devinfo.Codepage(),
+		NoResponse: true,
+	})
+}
+
+// idleWarningRefresh is how often the countdown on the idle warning screen
+// is updated.
+const idleWarningRefresh = 5 * time.Second
+
+// showIdleWarning warns the user at the menu that they are about to be
+// disconnected for inactivity, counting down for the length of warning. It
+// returns true if the user pressed a key to stay connected, or false if the
+// time ran out.
+func showIdleWarning(conn net.Conn, devinfo go3270.DevInfo, warning time.Duration) (bool, error) {
+	defer conn.SetReadDeadline(time.Time{})
+	end := time.Now().Add(warning)
+	for {
+		remaining := time.Until(end)
+		if remaining <= 0 {
+			return false, nil
+		}
+		wait := remaining
+		if wait > idleWarningRefresh {
+			wait = idleWarningRefresh
+		}
+		conn.SetReadDeadline(time.Now().Add(wait))
+		if sessions.isShuttingDown() {
+			return false, fmt.Errorf("shutting down")
+		}
+
+		// Round the countdown up, so we never show zero seconds left.
+		seconds := int((remaining + time.Second - 1) / time.Second)
+		screen := go3270.Screen{
+			{Row: 0, Col: 0, Intense: true, Color: go3270.Yellow,
+				Content: "Are you still there?"},
+			{Row: 2, Col: 0,
+				Content: "You will be disconnected for inactivity in"},
+			{Row: 2, Col: 43, Intense: true,
+				Content: fmt.Sprintf("%d seconds.", seconds)},
+			{Row: 4, Col: 0, Content: "Press ENTER to stay connected."},
+		}
+		_, err := go3270.ShowScreenOpts(screen, nil, conn, go3270.ScreenOpts{
+			AltScreen: devinfo,
+			Codepage:  devinfo.Codepage(),
+		})
+		if err != nil && isTimeout(err) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+}
+
+// showIdleGoodbyeScreen tells the user they were disconnected for
+// inactivity.
+func showIdleGoodbyeScreen(conn net.Conn, devinfo go3270.DevInfo) {
+	screen := go3270.Screen{
+		{Row: 0, Col: 0, Intense: true,
+			Content: "You have been disconnected due to inactivity."},
+		{Row: 2, Col: 0, Content: "Goodbye."},
+	}
+	go3270.ShowScreenOpts(screen, nil, conn, go3270.ScreenOpts{
+		AltScreen:  devinfo,
+		Codepage:   devinfo.Codepage(),
+		NoResponse: true,
+	})
+}
+
+// errorScreenLinger is how long we leave an error screen up before
+// disconnecting, if the user doesn't press a key first. Many emulators
+// clear the screen when the connection closes.
+const errorScreenLinger = 15 * time.Second
+
+// showAccessDeniedScreen tells the user they aren't permitted to connect
+// from where they are, and waits briefly for them to read it.
+func showAccessDeniedScreen(conn net.Conn, devinfo go3270.DevInfo) {
+	screen := go3270.Screen{
+		{Row: 0, Col: 0, Intense: true, Color: go3270.Red,
+			Content: "Access denied."},
+		{Row: 2, Col: 0,
+			Content: "Connections are not permitted from your network address."},
+	}
+	conn.SetReadDeadline(time.Now().Add(errorScreenLinger))
+	go3270.ShowScreenOpts(screen, nil, conn, go3270.ScreenOpts{
+		AltScreen: devinfo,
+		Codepage:  devinfo.Codepage(),
+	})
+}
+
+// showCertChangedScreen tells the user we refused to connect them to a
+// server because its certificate changed, and waits briefly for them to
+// read it.
+func showCertChangedScreen(conn net.Conn, devinfo go3270.DevInfo, name string) {
+	screen := go3270.Screen{
+		{Row: 0, Col: 0, Intense: true, Color: go3270.Red,
+			Content: "Unable to connect to:"},
+		{Row: 1, Col: 0, Intense: true, Content: name},
+		{Row: 3, Col: 0,
+			Content: "The server's security certificate has changed unexpectedly."},
+		{Row: 4, Col: 0,
+			Content: "Please contact the system administrator."},
+	}
+	conn.SetReadDeadline(time.Now().Add(errorScreenLinger))
+	go3270.ShowScreenOpts(screen, nil, conn, go3270.ScreenOpts{
+		AltScreen: devinfo,
+		Codepage:  devinfo.Codepage(),
+	})
+}
+
 // wrapDisclaimer will split the input string into line1 with no more than
 // linelength characters, and the remaining text in line2.
 // CAVEATS: line2 may extend longer than the linelength. This function is
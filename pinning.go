@@ -0,0 +1,329 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultKnownServersFile is where we record the certificates of servers
+// that use trust on first use, unless the configuration says otherwise.
+const defaultKnownServersFile = "known_servers"
+
+const pinPrefix = "sha256/"
+
+// certFingerprint returns the SHA-256 hash of the certificate's public key
+// (its SubjectPublicKeyInfo) as sha256/<base64>. Because it covers only the
+// key, the fingerprint stays the same when a certificate is renewed with
+// the same key.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// validatePin checks that pin is a fingerprint in the form certFingerprint
+// produces.
+func validatePin(pin string) error {
+	if !strings.HasPrefix(pin, pinPrefix) {
+		return fmt.Errorf("pin `%s` must start with %s", pin, pinPrefix)
+	}
+	b, err := base64.StdEncoding.DecodeString(pin[len(pinPrefix):])
+	if err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("pin `%s` is not a base64 SHA-256 hash", pin)
+	}
+	return nil
+}
+
+// certChangedError is returned when a server presents a certificate that
+// doesn't match its pins or the one we trusted on first use.
+type certChangedError struct {
+	server   string
+	expected string
+	got      string
+}
+
+func (e *certChangedError) Error() string {
+	return fmt.Sprintf("certificate for server `%s` has changed: expected %s, got %s",
+		e.server, e.expected, e.got)
+}
+
+// pinned reports whether the endpoint's certificate is checked against
+// fingerprints rather than verified with a CA.
+func (ep *endpoint) pinned() bool {
+	return len(ep.Pins) > 0 || ep.TrustOnFirstUse
+}
+
+// verifyPin checks the certificate an endpoint presented against its pins,
+// or, for trust on first use, the fingerprint we recorded the first time we
+// connected. If this is the first time and record is set, the fingerprint is
+// recorded now; otherwise, with nothing to compare, the certificate is
+// accepted.
+func (ep *endpoint) verifyPin(config *Config, cert *x509.Certificate, record bool) error {
+	got := certFingerprint(cert)
+	if len(ep.Pins) > 0 {
+		for _, pin := range ep.Pins {
+			if pin == got {
+				return nil
+			}
+		}
+		return &certChangedError{server: ep.server.Name,
+			expected: strings.Join(ep.Pins, " or "), got: got}
+	}
+
+	addr := ep.address()
+	file := config.knownServersFile()
+	var expected string
+	var err error
+	if record {
+		expected, err = knownServers.setIfAbsent(file, addr, got)
+	} else {
+		expected, err = knownServers.lookup(file, addr)
+	}
+	if err != nil {
+		return err
+	}
+	if expected == "" {
+		if record {
+			l.Log(InfoLvl, "Trusting certificate for server `%s` (%s) on first use: %s",
+				ep.server.Name, addr, got)
+		}
+		return nil
+	}
+	if expected != got {
+		return &certChangedError{server: ep.server.Name, expected: expected, got: got}
+	}
+	return nil
+}
+
+func (c *Config) knownServersFile() string {
+	if c.KnownServers != "" {
+		return c.KnownServers
+	}
+	return defaultKnownServersFile
+}
+
+// knownServerStore reads and updates known servers files. Each line of a
+// file is a server's host:port and the fingerprint of its certificate. The
+// file is read on every lookup, so changes made by -acceptCert take effect
+// immediately.
+type knownServerStore struct {
+	mu sync.Mutex
+}
+
+var knownServers = &knownServerStore{}
+
+// lookup returns the fingerprint recorded for addr, or the empty string if
+// there isn't one.
+func (k *knownServerStore) lookup(file, addr string) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	entries, err := readKnownServers(file)
+	if err != nil {
+		return "", err
+	}
+	return entries[addr], nil
+}
+
+// set records fingerprint for addr, replacing any previous fingerprint.
+func (k *knownServerStore) set(file, addr, fingerprint string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	entries, err := readKnownServers(file)
+	if err != nil {
+		return err
+	}
+	entries[addr] = fingerprint
+	return writeKnownServers(file, entries)
+}
+
+// setIfAbsent records fingerprint for addr if there isn't a fingerprint for
+// it already, and returns the one that was there, or the empty string if
+// there wasn't one. Looking and recording under one lock means that when
+// two connections are first at once, the second is checked against the
+// first's certificate rather than replacing it.
+func (k *knownServerStore) setIfAbsent(file, addr, fingerprint string) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	entries, err := readKnownServers(file)
+	if err != nil {
+		return "", err
+	}
+	if existing := entries[addr]; existing != "" {
+		return existing, nil
+	}
+	entries[addr] = fingerprint
+	return "", writeKnownServers(file, entries)
+}
+
+// writeKnownServers replaces the contents of file with entries. The caller
+// must hold the store's lock.
+func writeKnownServers(file string, entries map[string]string) error {
+	// Write the new file alongside the old one and rename it into place, so
+	// that a concurrent reader never sees a partial file.
+	f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "# proxy3270 known servers: host:port and certificate public key fingerprint")
+	addrs := make([]string, 0, len(entries))
+	for a := range entries {
+		addrs = append(addrs, a)
+	}
+	sort.Strings(addrs)
+	for _, a := range addrs {
+		fmt.Fprintln(w, a, entries[a])
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+func readKnownServers(file string) (map[string]string, error) {
+	entries := make(map[string]string)
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || validatePin(fields[1]) != nil {
+			return nil, fmt.Errorf("%s line %d: invalid entry", file, lineno)
+		}
+		entries[fields[0]] = fields[1]
+	}
+	return entries, scanner.Err()
+}
+
+// acceptServerCert connects to each endpoint of the named server that uses
+// trust on first use, and records the fingerprint of the certificate it
+// presents as the trusted one, replacing any previous fingerprint. This is
+// run from the command line with -acceptCert after an administrator has
+// confirmed that a server's certificate was changed legitimately.
+func acceptServerCert(config *Config, name string) error {
+	var target *ServerConfig
+	for i := range config.Servers {
+		if config.Servers[i].Name == name {
+			target = &config.Servers[i]
+			break
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("no server named `%s`", name)
+	}
+
+	var accepted int
+	var failed error
+	for _, ep := range target.endpoints() {
+		if !ep.UseTLS || !ep.TrustOnFirstUse {
+			continue
+		}
+		accepted++
+		if err := ep.acceptCert(config); err != nil {
+			l.LogWithErr(ErrorLvl, err, "Couldn't accept certificate for server `%s` (%s)",
+				name, ep.address())
+			failed = err
+		}
+	}
+	if accepted == 0 {
+		return fmt.Errorf("server `%s` doesn't use trustOnFirstUse", name)
+	}
+	return failed
+}
+
+// acceptCert records the fingerprint of the certificate the endpoint
+// presents as the trusted one.
+func (ep *endpoint) acceptCert(config *Config) error {
+	tlsConfig, err := ep.tlsClientConfig(config)
+	if err != nil {
+		return err
+	}
+	tlsConfig.VerifyConnection = nil
+
+	timeouts := config.timeouts(ep.server)
+	conn, err := dialServer(config, ep,
+		time.Now().Add(time.Duration(timeouts.Dial)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if ep.server.ProxyProtocol != 0 {
+		if err := writeProxyHeader(conn, ep.server.ProxyProtocol,
+			conn.LocalAddr(), conn.RemoteAddr()); err != nil {
+			return err
+		}
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(
+		time.Duration(timeouts.ServerTLSHandshake)))
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	cert := tlsConn.ConnectionState().PeerCertificates[0]
+
+	addr := ep.address()
+	file := config.knownServersFile()
+	old, err := knownServers.lookup(file, addr)
+	if err != nil {
+		return err
+	}
+	fingerprint := certFingerprint(cert)
+	if old == fingerprint {
+		l.Log(InfoLvl, "Certificate for server `%s` (%s) is already trusted: %s",
+			ep.server.Name, addr, fingerprint)
+		return nil
+	}
+	if err := knownServers.set(file, addr, fingerprint); err != nil {
+		return err
+	}
+	if old == "" {
+		old = "none"
+	}
+	l.Log(InfoLvl, "Accepted certificate for server `%s` (%s), subject %s: %s (previously %s)",
+		ep.server.Name, addr, cert.Subject, fingerprint, old)
+	return nil
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// handshake connects to the server with TLS and reports any error.
+func handshake(config *Config, target *ServerConfig) error {
+	conn, _, err := connectServer(config, target, nil, nil)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestCertPinning(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue("mainframe.internal")
+	port := tlsServer(t, certFile, keyFile, nil)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	fingerprint := certFingerprint(leaf)
+	other := "sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+
+	config := &Config{
+		KnownServers: filepath.Join(t.TempDir(), "known_servers"),
+		Servers: []ServerConfig{{Name: "Test", EndpointConfig: EndpointConfig{
+			Host: "127.0.0.1", Port: port, UseTLS: true, TrustOnFirstUse: true}}},
+	}
+	target := &config.Servers[0]
+	var changed *certChangedError
+
+	// The first connection records the certificate, and later ones must
+	// present the same one.
+	if err := handshake(config, target); err != nil {
+		t.Fatalf("first use: unexpected error: %v", err)
+	}
+	if got, _ := knownServers.lookup(config.KnownServers, target.endpoints()[0].address()); got != fingerprint {
+		t.Errorf("recorded %s; we expected %s", got, fingerprint)
+	}
+	if err := handshake(config, target); err != nil {
+		t.Errorf("second use: unexpected error: %v", err)
+	}
+	knownServers.set(config.KnownServers, target.endpoints()[0].address(), other)
+	if err := handshake(config, target); !errors.As(err, &changed) {
+		t.Errorf("changed certificate: got %v; we expected certChangedError", err)
+	}
+	if err := acceptServerCert(config, "Test"); err != nil {
+		t.Fatalf("acceptServerCert: unexpected error: %v", err)
+	}
+	if err := handshake(config, target); err != nil {
+		t.Errorf("after acceptServerCert: unexpected error: %v", err)
+	}
+
+	target = &ServerConfig{Name: "Test", EndpointConfig: EndpointConfig{
+		Host: "127.0.0.1", Port: port, UseTLS: true,
+		Pins: []string{other, fingerprint}}}
+	if err := handshake(config, target); err != nil {
+		t.Errorf("pinned: unexpected error: %v", err)
+	}
+	target.Pins = []string{other}
+	if err := handshake(config, target); !errors.As(err, &changed) {
+		t.Errorf("wrong pin: got %v; we expected certChangedError", err)
+	}
+}
+
+func TestKnownServersFirstUse(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "known_servers")
+	fingerprints := []string{
+		"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+		"sha256/LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=",
+	}
+
+	// Of several first connections at once, exactly one gets to record its
+	// fingerprint, and the others are told what it was.
+	var wg sync.WaitGroup
+	results := make(chan string, 2*len(fingerprints))
+	for i := 0; i < 2*len(fingerprints); i++ {
+		wg.Add(1)
+		go func(fingerprint string) {
+			defer wg.Done()
+			existing, err := knownServers.setIfAbsent(file, "mainframe:992", fingerprint)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			results <- existing
+		}(fingerprints[i%len(fingerprints)])
+	}
+	wg.Wait()
+	close(results)
+
+	recorded, _ := knownServers.lookup(file, "mainframe:992")
+	var first int
+	for existing := range results {
+		if existing == "" {
+			first++
+		} else if existing != recorded {
+			t.Errorf("told %s was recorded; we expected %s", existing, recorded)
+		}
+	}
+	if first != 1 {
+		t.Errorf("%d connections recorded a fingerprint; we expected 1", first)
+	}
+}
@@ -20,7 +20,7 @@
 package main
 
 import (
-	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -28,77 +28,156 @@ import (
 	"time"
 )
 
-func proxy(client net.Conn, targetHost string, targetPort uint, useTLS, ignoreCertErrors bool) error {
-	server, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", targetHost,
-		targetPort), 15*time.Second)
+func proxy(client net.Conn, s *activeSession, config *Config, target *ServerConfig) error {
+	timeouts := config.timeouts(target)
+
+	server, ep, err := connectServer(config, target, client.RemoteAddr(),
+		client.LocalAddr())
+	breakers.record(config, target, err)
 	if err != nil {
 		return err
 	}
 	defer server.Close()
+	sessions.setEndpoint(s, ep.address())
+	l.Log(InfoLvl, "Client %s connected to server `%s` at %s", s.clientName(),
+		target.Name, ep.address())
 
-	if useTLS {
-		tlsConfig := &tls.Config{
-			ServerName:         targetHost,
-			InsecureSkipVerify: ignoreCertErrors,
-		}
-		server = tls.Client(server, tlsConfig)
+	// The watchdog and session timer end the session by closing the client
+	// connection, which the copy loops below notice.
+	idle := newIdleWatchdog(time.Duration(timeouts.SessionIdle), func() {
+		sessions.end(s, fmt.Sprintf("idle for %s",
+			time.Duration(timeouts.SessionIdle)))
+	})
+	defer idle.stop()
+	if maxSession := time.Duration(timeouts.MaxSession); maxSession > 0 {
+		timer := time.AfterFunc(maxSession, func() {
+			sessions.end(s, fmt.Sprintf("maximum session time of %s reached",
+				maxSession))
+		})
+		defer timer.Stop()
 	}
 
-	clientdone := make(chan bool)
-	clientend := make(chan bool)
-	serverdone := make(chan bool)
-	serverend := make(chan bool)
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go readAndFeed("client", client, server, &wg, clientend, clientdone)
-	go readAndFeed("server", server, client, &wg, serverend, serverdone)
-
-	select {
-	case <-serverdone:
-		l.Log(DebugLvl, "got serverdone")
-		clientend <- true
-	case <-clientdone:
-		l.Log(DebugLvl, "got clientdone")
-		serverend <- true
-	}
+	// Telnet keepalive probes are written to the client between the
+	// server's data.
+	clientOut := newTelnetWriter(client)
+	probes := newProber(config.Keepalive, clientOut)
+	probesDone := make(chan struct{})
+	defer close(probesDone)
+	go probes.run(probesDone, func(reason string) {
+		sessions.end(s, reason)
+	})
 
-	wg.Wait()
+	relay(client, server, clientOut, probes.filter, idle)
 
 	return nil
 }
 
-func readAndFeed(name string, in, out net.Conn, wg *sync.WaitGroup, end, done chan bool) {
-	defer func() {
-		close(done)
-		in.SetReadDeadline(time.Time{})
-		l.Log(DebugLvl, "ending readAndFeed(): %s", name)
-		wg.Done()
+// copyBufferSize is the size of the buffers used to copy data between
+// clients and servers, which are shared between sessions through
+// copyBuffers.
+const copyBufferSize = 32 * 1024
+
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// halfCloseTimeout is how long we let data keep flowing in one direction
+// after the other direction has been closed cleanly.
+const halfCloseTimeout = 15 * time.Second
+
+// relay copies data between the client and server in both directions until
+// both are finished. Data for the client is written to toClient, which wraps
+// the client connection, and data from the client is passed through filter
+// if it isn't nil.
+//
+// Each direction blocks in Read until there is data, so an idle session
+// costs nothing but its two goroutines. When one side closes its end
+// cleanly, we pass the half-close on to the other side and give the other
+// direction a chance to finish. If either direction fails, or the session
+// is ended by closing one of the connections, both connections are closed.
+func relay(client, server net.Conn, toClient io.Writer, filter func([]byte) []byte, idle *idleWatchdog) {
+	done := make(chan error, 2)
+	go func() {
+		err := pump("client", client, server, filter, idle)
+		if err == nil {
+			closeWrite(server)
+		}
+		done <- err
+	}()
+	go func() {
+		err := pump("server", server, toClient, nil, idle)
+		if err == nil {
+			closeWrite(client)
+		}
+		done <- err
 	}()
-	l.Log(DebugLvl, "starting readAndFeed(): %s", name)
-	buffer := make([]byte, 1024)
-	finish := false
-	for !finish {
-		select {
-		case <-end:
-			l.Log(DebugLvl, "%s got end signal", name)
-			finish = true
-		default:
-			in.SetReadDeadline(time.Now().Add(time.Second / 2))
-			n, err := in.Read(buffer)
-			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-				continue
-			} else if err == io.EOF {
-				l.Log(DebugLvl, "connection closed: %s", name)
-				return
-			} else if err != nil {
-				l.LogWithErr(ErrorLvl, err, "read error: %s", name)
-				return
+
+	if err := <-done; err != nil {
+		client.Close()
+		server.Close()
+	} else {
+		timer := time.AfterFunc(halfCloseTimeout, func() {
+			l.Log(DebugLvl, "half-closed session timed out")
+			client.Close()
+			server.Close()
+		})
+		defer timer.Stop()
+	}
+	<-done
+}
+
+// pump copies data from in to out until in reaches EOF, which is reported as
+// a nil error, or either side fails.
+func pump(name string, in net.Conn, out io.Writer, filter func([]byte) []byte, idle *idleWatchdog) error {
+	l.Log(DebugLvl, "starting pump(): %s", name)
+	defer l.Log(DebugLvl, "ending pump(): %s", name)
+
+	bufp := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(bufp)
+	buffer := *bufp
+
+	for {
+		n, err := in.Read(buffer)
+		if n > 0 {
+			data := buffer[:n]
+			if filter != nil {
+				data = filter(data)
 			}
-			l.Log(TraceLvl, "%s read data: [%X]", name, buffer[:n])
-			if _, err := out.Write(buffer[:n]); err != nil {
-				l.LogWithErr(ErrorLvl, err, "write error: %s", name)
-				return
+			if len(data) > 0 {
+				idle.touch()
+				l.Log(TraceLvl, "%s read data: [%X]", name, data)
+				if _, werr := out.Write(data); werr != nil {
+					if !errors.Is(werr, net.ErrClosed) {
+						l.LogWithErr(ErrorLvl, werr, "write error: %s", name)
+					}
+					return werr
+				}
 			}
 		}
+		if err == io.EOF {
+			l.Log(DebugLvl, "connection closed: %s", name)
+			return nil
+		} else if errors.Is(err, net.ErrClosed) {
+			// We closed the connection ourselves (e.g. for shutdown)
+			l.Log(DebugLvl, "connection closed locally: %s", name)
+			return err
+		} else if err != nil {
+			l.LogWithErr(ErrorLvl, err, "read error: %s", name)
+			return err
+		}
+	}
+}
+
+// closeWrite shuts down the writing side of conn, if it supports that, so
+// the peer sees the end of the data while we can still read from it.
+// Otherwise, conn is closed entirely.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
 	}
+	conn.Close()
 }
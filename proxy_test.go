@@ -0,0 +1,289 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	if b == nil {
+		t.Fatal("couldn't accept connection")
+	}
+	return a, b
+}
+
+// relayFixture is a client and server connected through a relay engine.
+type relayFixture struct {
+	client, server net.Conn // the outside ends
+	proxyClient    net.Conn // the engine's end of the client connection
+	done           chan struct{}
+}
+
+func newRelayFixture(t testing.TB, engine func(client, server net.Conn)) *relayFixture {
+	client, proxyClient := tcpPair(t)
+	proxyServer, server := tcpPair(t)
+	f := &relayFixture{client: client, server: server,
+		proxyClient: proxyClient, done: make(chan struct{})}
+	go func() {
+		engine(proxyClient, proxyServer)
+		proxyClient.Close()
+		proxyServer.Close()
+		close(f.done)
+	}()
+	return f
+}
+
+// stop ends the session the way the session timeouts do, by closing the
+// engine's client connection, and cleans up.
+func (f *relayFixture) stop(t testing.TB) {
+	f.proxyClient.Close()
+	f.waitDone(t)
+	f.client.Close()
+	f.server.Close()
+}
+
+func (f *relayFixture) waitDone(t testing.TB) {
+	select {
+	case <-f.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("relay didn't finish")
+	}
+}
+
+func relayEngine(client, server net.Conn) {
+	relay(client, server, client, nil, nil)
+}
+
+func TestRelay(t *testing.T) {
+	// Data flows both ways.
+	f := newRelayFixture(t, relayEngine)
+	f.client.Write([]byte("to server"))
+	buf := make([]byte, 100)
+	n, _ := f.server.Read(buf)
+	if string(buf[:n]) != "to server" {
+		t.Errorf("server got `%s`", buf[:n])
+	}
+	f.server.Write([]byte("to client"))
+	n, _ = f.client.Read(buf)
+	if string(buf[:n]) != "to client" {
+		t.Errorf("client got `%s`", buf[:n])
+	}
+
+	// When the client half-closes, the server sees EOF but can still send
+	// to the client.
+	f.client.(*net.TCPConn).CloseWrite()
+	if _, err := f.server.Read(buf); err != io.EOF {
+		t.Errorf("server read after client half-close: %v; we expected EOF", err)
+	}
+	f.server.Write([]byte("still here"))
+	n, _ = f.client.Read(buf)
+	if string(buf[:n]) != "still here" {
+		t.Errorf("client got `%s` after half-close", buf[:n])
+	}
+	f.server.Close()
+	f.waitDone(t)
+	f.client.Close()
+
+	// Closing the proxy's client connection, as the session timeouts do,
+	// tears down the whole session.
+	f = newRelayFixture(t, relayEngine)
+	f.proxyClient.Close()
+	f.waitDone(t)
+	f.server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := f.server.Read(buf); err == nil {
+		t.Errorf("server connection should have been closed")
+	}
+	f.client.Close()
+	f.server.Close()
+}
+
+// The benchmarks compare relay() with the polling implementation it
+// replaced, which is kept here for the purpose.
+
+func legacyEngine(client, server net.Conn) {
+	clientdone := make(chan bool)
+	clientend := make(chan bool)
+	serverdone := make(chan bool)
+	serverend := make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go legacyReadAndFeed("client", client, server, &wg, clientend, clientdone)
+	go legacyReadAndFeed("server", server, client, &wg, serverend, serverdone)
+
+	select {
+	case <-serverdone:
+		clientend <- true
+	case <-clientdone:
+		serverend <- true
+	}
+
+	wg.Wait()
+}
+
+func legacyReadAndFeed(name string, in, out net.Conn, wg *sync.WaitGroup, end, done chan bool) {
+	defer func() {
+		close(done)
+		in.SetReadDeadline(time.Time{})
+		wg.Done()
+	}()
+	buffer := make([]byte, 1024)
+	finish := false
+	for !finish {
+		select {
+		case <-end:
+			finish = true
+		default:
+			in.SetReadDeadline(time.Now().Add(time.Second / 2))
+			n, err := in.Read(buffer)
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				continue
+			} else if err != nil {
+				return
+			}
+			if _, err := out.Write(buffer[:n]); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func BenchmarkRelayThroughput(b *testing.B) {
+	benchmarkThroughput(b, relayEngine)
+}
+
+func BenchmarkLegacyThroughput(b *testing.B) {
+	benchmarkThroughput(b, legacyEngine)
+}
+
+func benchmarkThroughput(b *testing.B, engine func(client, server net.Conn)) {
+	f := newRelayFixture(b, engine)
+	chunk := bytes.Repeat([]byte{0x40}, 32*1024)
+	total := int64(len(chunk)) * int64(b.N)
+
+	received := make(chan struct{})
+	go func() {
+		var n int64
+		buf := make([]byte, 64*1024)
+		for n < total {
+			m, err := f.server.Read(buf)
+			n += int64(m)
+			if err != nil {
+				break
+			}
+		}
+		close(received)
+	}()
+
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.client.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	<-received
+	b.StopTimer()
+
+	f.stop(b)
+}
+
+func BenchmarkRelayIdle(b *testing.B) {
+	benchmarkIdle(b, relayEngine)
+}
+
+func BenchmarkLegacyIdle(b *testing.B) {
+	benchmarkIdle(b, legacyEngine)
+}
+
+// countingConn counts calls to Read, each of which is a wakeup for the
+// goroutine doing the reading.
+type countingConn struct {
+	net.Conn
+	reads *int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	atomic.AddInt64(c.reads, 1)
+	return c.Conn.Read(p)
+}
+
+// benchmarkIdle measures the CPU time and wakeups used by sessions that
+// have no traffic. Each iteration leaves the sessions idle for a fixed
+// period.
+func benchmarkIdle(b *testing.B, engine func(client, server net.Conn)) {
+	const count = 100
+	const period = 500 * time.Millisecond
+
+	var reads int64
+	counted := func(client, server net.Conn) {
+		engine(countingConn{client, &reads}, countingConn{server, &reads})
+	}
+	var fixtures []*relayFixture
+	for i := 0; i < count; i++ {
+		fixtures = append(fixtures, newRelayFixture(b, counted))
+	}
+
+	// Let the sessions settle before measuring.
+	time.Sleep(100 * time.Millisecond)
+	atomic.StoreInt64(&reads, 0)
+	startCPU := cpuTime()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		time.Sleep(period)
+	}
+	b.StopTimer()
+	cpu := cpuTime() - startCPU
+
+	sessionSeconds := float64(count) * period.Seconds() * float64(b.N)
+	b.ReportMetric(float64(cpu.Nanoseconds())/sessionSeconds, "cpu-ns/session-s")
+	b.ReportMetric(float64(atomic.LoadInt64(&reads))/sessionSeconds, "reads/session-s")
+
+	for _, f := range fixtures {
+		f.stop(b)
+	}
+}
@@ -0,0 +1,362 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file implements both the sending and receiving sides of the HAProxy
+// PROXY protocol, versions 1 and 2, as described in
+// https://www.haproxy.org/download/2.4/doc/proxy-protocol.txt
+
+// proxyHeaderTimeout is how long we wait for a load balancer to send the
+// complete PROXY protocol header after connecting.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV1MaxLength is the longest a version 1 header may be, including the
+// trailing CRLF.
+const proxyV1MaxLength = 107
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errBadProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxiedConn is a connection that arrived through a load balancer. It
+// reports the original client and destination addresses from the PROXY
+// protocol header instead of the addresses of the load balancer connection.
+type proxiedConn struct {
+	net.Conn
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr { return c.remoteAddr }
+func (c *proxiedConn) LocalAddr() net.Addr  { return c.localAddr }
+
+// CloseWrite half-closes the underlying connection, if it supports that.
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// readProxyHeader consumes a PROXY protocol v1 or v2 header from the
+// beginning of conn and returns a connection that reports the addresses
+// carried in the header. The header is read exactly, so no data following
+// it is consumed. If the header is a LOCAL command (e.g. a load balancer
+// health check) or carries an address family we don't understand, the
+// returned connection reports the real addresses of conn.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// Every v2 header is at least as long as the signature, and every v1
+	// header is longer than that, so this first read is always safe.
+	start := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(conn, start); err != nil {
+		return nil, err
+	}
+
+	var remote, local net.Addr
+	var err error
+	if bytes.Equal(start, proxyV2Signature) {
+		remote, local, err = readProxyV2(conn)
+	} else if bytes.HasPrefix(start, []byte("PROXY ")) {
+		remote, local, err = readProxyV1(conn, start)
+	} else {
+		return nil, errBadProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if remote == nil {
+		return conn, nil
+	}
+	return &proxiedConn{Conn: conn, remoteAddr: remote, localAddr: local}, nil
+}
+
+// readProxyV1 reads the remainder of a text (version 1) header, the first
+// bytes of which have already been read into start.
+func readProxyV1(conn net.Conn, start []byte) (remote, local net.Addr, err error) {
+	line := append([]byte{}, start...)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, nil, errBadProxyHeader
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	return parseProxyV1(string(line[:len(line)-2]))
+}
+
+// parseProxyV1 interprets a version 1 header line, without the CRLF.
+func parseProxyV1(line string) (remote, local net.Addr, err error) {
+	fields := strings.Split(line, " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, nil, errBadProxyHeader
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		// The sender doesn't know the addresses; the rest of the line is
+		// to be ignored.
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, errBadProxyHeader
+	}
+
+	if len(fields) != 6 {
+		return nil, nil, errBadProxyHeader
+	}
+
+	srcIP := net.ParseIP(fields[2])
+	dstIP := net.ParseIP(fields[3])
+	if srcIP == nil || dstIP == nil {
+		return nil, nil, errBadProxyHeader
+	}
+	if (fields[1] == "TCP4") != (srcIP.To4() != nil && dstIP.To4() != nil) {
+		return nil, nil, errBadProxyHeader
+	}
+
+	srcPort, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, nil, errBadProxyHeader
+	}
+	dstPort, err := strconv.ParseUint(fields[5], 10, 16)
+	if err != nil {
+		return nil, nil, errBadProxyHeader
+	}
+
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)},
+		&net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// readProxyV2 reads the remainder of a binary (version 2) header after the
+// signature.
+func readProxyV2(conn net.Conn) (remote, local net.Addr, err error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return nil, nil, err
+	}
+
+	version, command := hdr[0]>>4, hdr[0]&0x0f
+	if version != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version %d",
+			version)
+	}
+
+	// We always need to consume the entire address block, even if we don't
+	// end up using it, so the next byte read is the client's data.
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[2:4]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, nil, err
+	}
+
+	switch command {
+	case 0x0:
+		// LOCAL: the connection was made by the proxy itself.
+		return nil, nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, nil, errBadProxyHeader
+	}
+
+	return parseProxyV2Addrs(hdr[1], payload)
+}
+
+// parseProxyV2Addrs decodes the address block of a version 2 header for the
+// given address family/protocol byte.
+func parseProxyV2Addrs(famProto byte, payload []byte) (remote, local net.Addr, err error) {
+	// We only handle stream connections over IPv4 and IPv6. Anything else
+	// gets treated like UNKNOWN.
+	var ipLen int
+	switch famProto {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+
+	if len(payload) < ipLen*2+4 {
+		return nil, nil, errBadProxyHeader
+	}
+	srcIP := net.IP(append([]byte{}, payload[:ipLen]...))
+	dstIP := net.IP(append([]byte{}, payload[ipLen:ipLen*2]...))
+	srcPort := binary.BigEndian.Uint16(payload[ipLen*2:])
+	dstPort := binary.BigEndian.Uint16(payload[ipLen*2+2:])
+
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)},
+		&net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// writeProxyHeader sends a PROXY protocol header of the given version (1 or
+// 2) to w describing a connection from src to dst. If the addresses aren't
+// TCP addresses, an UNKNOWN (v1) or LOCAL (v2) header is sent instead.
+func writeProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	var header []byte
+	if version == 1 {
+		header = buildProxyV1(src, dst)
+	} else {
+		header = buildProxyV2(src, dst)
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+// proxyHeaderAddrs returns the source and destination TCP addresses for a
+// PROXY header, and whether both can be sent as IPv4. ok is false if either
+// address isn't a TCP address.
+func proxyHeaderAddrs(src, dst net.Addr) (srcAddr, dstAddr *net.TCPAddr, v4 bool, ok bool) {
+	srcAddr, ok1 := src.(*net.TCPAddr)
+	dstAddr, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return nil, nil, false, false
+	}
+
+	// If a v4 client came in on a dual-stack v6 socket, or vice-versa, send
+	// both in v6 form since the header can only carry one family.
+	v4 = srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil
+	return srcAddr, dstAddr, v4, true
+}
+
+func buildProxyV1(src, dst net.Addr) []byte {
+	srcAddr, dstAddr, v4, ok := proxyHeaderAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	// net.IP.String() renders v4-mapped v6 addresses in dotted-quad form,
+	// which isn't valid for TCP6, so we format those ourselves.
+	proto := "TCP6"
+	srcIP, dstIP := ipv6String(srcAddr.IP), ipv6String(dstAddr.IP)
+	if v4 {
+		proto = "TCP4"
+		srcIP, dstIP = srcAddr.IP.To4().String(), dstAddr.IP.To4().String()
+	}
+
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP,
+		dstIP, srcAddr.Port, dstAddr.Port))
+}
+
+// ipv6String formats ip in IPv6 notation even if it is an IPv4 address.
+func ipv6String(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("::ffff:%x:%x", uint16(v4[0])<<8|uint16(v4[1]),
+			uint16(v4[2])<<8|uint16(v4[3]))
+	}
+	return ip.String()
+}
+
+func buildProxyV2(src, dst net.Addr) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+
+	srcAddr, dstAddr, v4, ok := proxyHeaderAddrs(src, dst)
+	if !ok {
+		// LOCAL command, unspecified family, no addresses
+		return append(header, 0x20, 0x00, 0, 0)
+	}
+
+	var famProto byte
+	var srcIP, dstIP net.IP
+	if v4 {
+		famProto = 0x11
+		srcIP, dstIP = srcAddr.IP.To4(), dstAddr.IP.To4()
+	} else {
+		famProto = 0x21
+		srcIP, dstIP = srcAddr.IP.To16(), dstAddr.IP.To16()
+	}
+
+	addrs := make([]byte, 0, len(srcIP)*2+4)
+	addrs = append(addrs, srcIP...)
+	addrs = append(addrs, dstIP...)
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[0:], uint16(srcAddr.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dstAddr.Port))
+	addrs = append(addrs, ports[:]...)
+
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(addrs)))
+	header = append(header, 0x21, famProto)
+	header = append(header, length[:]...)
+	return append(header, addrs...)
+}
+
+// parseCIDRList parses a list of CIDR blocks. A bare IP address is treated
+// as a single-host block. Blank entries are ignored.
+func parseCIDRList(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address `%s`", entry)
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// addrInNets reports whether addr is a TCP address whose IP falls within
+// any of nets.
+func addrInNets(addr net.Addr, nets []*net.IPNet) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
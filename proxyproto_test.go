@@ -0,0 +1,186 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	type TestCase struct {
+		Name   string
+		Header []byte
+		Remote string // blank if the connection's own address is expected
+		Local  string
+		Err    bool
+	}
+
+	v2 := func(cmd, fam byte, addrs ...byte) []byte {
+		b := append([]byte{}, proxyV2Signature...)
+		b = append(b, 0x20|cmd, fam, 0, byte(len(addrs)))
+		return append(b, addrs...)
+	}
+
+	testCases := []TestCase{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.10 198.51.100.1 51234 3270\r\n"),
+			"192.0.2.10:51234", "198.51.100.1:3270", false},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::10 2001:db8::1 51234 3270\r\n"),
+			"[2001:db8::10]:51234", "[2001:db8::1]:3270", false},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", "", false},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::10 2001:db8::1 1 2\r\n"),
+			"", "", true},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.10 198.51.100.1 99999 3270\r\n"),
+			"", "", true},
+		{"v1 missing fields", []byte("PROXY TCP4 192.0.2.10 198.51.100.1\r\n"),
+			"", "", true},
+		{"v2 TCP4", v2(1, 0x11, 192, 0, 2, 10, 198, 51, 100, 1, 0xc8, 0x22, 0x0c, 0xc6),
+			"192.0.2.10:51234", "198.51.100.1:3270", false},
+		{"v2 TCP6", v2(1, 0x21,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x10,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01,
+			0xc8, 0x22, 0x0c, 0xc6),
+			"[2001:db8::10]:51234", "[2001:db8::1]:3270", false},
+		{"v2 LOCAL", v2(0, 0x00), "", "", false},
+		{"v2 UNIX ignored", v2(1, 0x31, make([]byte, 216)...), "", "", false},
+		{"v2 short addresses", v2(1, 0x11, 192, 0, 2, 10), "", "", true},
+		{"not a header", []byte("\xff\xfd\x18 and some more bytes"), "", "", true},
+	}
+
+	for _, tc := range testCases {
+		client, server := net.Pipe()
+		go func(header []byte) {
+			client.Write(header)
+			client.Write([]byte("after"))
+			client.Close()
+		}(tc.Header)
+
+		conn, err := readProxyHeader(server)
+		if tc.Err {
+			if err == nil {
+				t.Errorf("%s: expected an error but got none", tc.Name)
+			}
+			server.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.Name, err)
+			server.Close()
+			continue
+		}
+
+		if tc.Remote == "" {
+			if conn != server {
+				t.Errorf("%s: expected the original connection back", tc.Name)
+			}
+		} else {
+			if conn.RemoteAddr().String() != tc.Remote {
+				t.Errorf("%s: remote address `%s`; we expected `%s`",
+					tc.Name, conn.RemoteAddr(), tc.Remote)
+			}
+			if conn.LocalAddr().String() != tc.Local {
+				t.Errorf("%s: local address `%s`; we expected `%s`",
+					tc.Name, conn.LocalAddr(), tc.Local)
+			}
+		}
+
+		rest, _ := io.ReadAll(conn)
+		if string(rest) != "after" {
+			t.Errorf("%s: data after the header was `%s`; we expected `after`",
+				tc.Name, rest)
+		}
+		server.Close()
+	}
+}
+
+func TestParseCIDRList(t *testing.T) {
+	nets, err := parseCIDRList([]string{"10.0.0.0/8", " 192.0.2.5",
+		"2001:db8::/32", ""})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(nets) != 3 {
+		t.Fatalf("got %d networks; we expected 3", len(nets))
+	}
+
+	in := []string{"10.1.2.3:1", "192.0.2.5:1", "[2001:db8::99]:1"}
+	out := []string{"11.0.0.1:1", "192.0.2.6:1", "[2001:db9::1]:1"}
+	for _, a := range in {
+		addr, _ := net.ResolveTCPAddr("tcp", a)
+		if !addrInNets(addr, nets) {
+			t.Errorf("%s should be in the list", a)
+		}
+	}
+	for _, a := range out {
+		addr, _ := net.ResolveTCPAddr("tcp", a)
+		if addrInNets(addr, nets) {
+			t.Errorf("%s should not be in the list", a)
+		}
+	}
+
+	if _, err := parseCIDRList([]string{"10.0.0.0/8", "bogus"}); err == nil {
+		t.Errorf("expected an error for an invalid entry")
+	}
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	type TestCase struct {
+		Version  int
+		Src, Dst string
+	}
+
+	testCases := []TestCase{
+		{1, "192.0.2.10:51234", "198.51.100.1:3270"},
+		{2, "192.0.2.10:51234", "198.51.100.1:3270"},
+		{1, "[2001:db8::10]:51234", "[2001:db8::1]:3270"},
+		{2, "[2001:db8::10]:51234", "[2001:db8::1]:3270"},
+		{1, "192.0.2.10:51234", "[2001:db8::1]:3270"},
+		{2, "192.0.2.10:51234", "[2001:db8::1]:3270"},
+	}
+
+	// Whatever we send, we should be able to read back.
+	for _, tc := range testCases {
+		src, _ := net.ResolveTCPAddr("tcp", tc.Src)
+		dst, _ := net.ResolveTCPAddr("tcp", tc.Dst)
+
+		client, server := net.Pipe()
+		go func(version int) {
+			writeProxyHeader(client, version, src, dst)
+			client.Close()
+		}(tc.Version)
+
+		conn, err := readProxyHeader(server)
+		if err != nil {
+			t.Errorf("v%d %s -> %s: couldn't read back header: %v",
+				tc.Version, tc.Src, tc.Dst, err)
+			server.Close()
+			continue
+		}
+		gotSrc := conn.RemoteAddr().(*net.TCPAddr)
+		gotDst := conn.LocalAddr().(*net.TCPAddr)
+		if !gotSrc.IP.Equal(src.IP) || gotSrc.Port != src.Port ||
+			!gotDst.IP.Equal(dst.IP) || gotDst.Port != dst.Port {
+			t.Errorf("v%d %s -> %s: read back as %s -> %s", tc.Version,
+				tc.Src, tc.Dst, gotSrc, gotDst)
+		}
+		server.Close()
+	}
+}
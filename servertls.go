@@ -0,0 +1,100 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// tlsClientConfig builds the TLS configuration for connecting to the
+// endpoint. The CA bundle and client certificate files are read each time, so
+// renewed files are picked up by the next connection.
+func (ep *endpoint) tlsClientConfig(config *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         ep.Host,
+		InsecureSkipVerify: ep.IgnoreCertValidation,
+	}
+	if ep.ServerName != "" {
+		tlsConfig.ServerName = ep.ServerName
+	}
+
+	if ep.ServerCA != "" {
+		pem, err := os.ReadFile(ep.ServerCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", ep.ServerCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if ep.ClientCertificate != "" {
+		cert, err := tls.LoadX509KeyPair(ep.ClientCertificate, ep.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load client certificate %s: %v",
+				ep.ClientCertificate, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// Pinned certificates are checked by fingerprint in place of the usual
+	// verification against a CA.
+	if ep.pinned() {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return ep.verifyPin(config, cs.PeerCertificates[0], true)
+		}
+	}
+
+	if err := config.TLS.merge(ep.TLS).apply(tlsConfig); err != nil {
+		return nil, err
+	}
+	return tlsConfig, nil
+}
+
+// validateTLS checks the endpoint's TLS settings, including that the files
+// they name can be loaded.
+func (ep *endpoint) validateTLS(config *Config) error {
+	if (ep.ClientCertificate == "") != (ep.ClientKey == "") {
+		return errors.New("clientCertificate and clientKey must be set together")
+	}
+	if ep.IgnoreCertValidation && (ep.ServerCA != "" || ep.ServerName != "") {
+		return errors.New("serverCA and serverName have no effect with ignoreCertValidation")
+	}
+	if len(ep.Pins) > 0 && ep.TrustOnFirstUse {
+		return errors.New("pins and trustOnFirstUse can't both be set")
+	}
+	if ep.pinned() && (ep.IgnoreCertValidation || ep.ServerCA != "") {
+		return errors.New("pins and trustOnFirstUse can't be used with ignoreCertValidation or serverCA")
+	}
+	for _, pin := range ep.Pins {
+		if err := validatePin(pin); err != nil {
+			return err
+		}
+	}
+	_, err := ep.tlsClientConfig(config)
+	return err
+}
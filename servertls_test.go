@@ -0,0 +1,202 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for tests, and writes them and their keys to
+// PEM files in a temporary directory.
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{t: t, dir: t.TempDir()}
+	ca.cert, ca.key, ca.file = ca.create("Test CA", nil, nil)
+	return ca
+}
+
+// issue creates a certificate for name, usable by both servers and
+// clients, and returns the certificate and key file names.
+func (ca *testCA) issue(name string) (certFile, keyFile string) {
+	_, key, certFile := ca.create(name, ca.cert, ca.key)
+	keyFile = certFile + ".key"
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	ca.write(keyFile, "EC PRIVATE KEY", der)
+	return certFile, keyFile
+}
+
+func (ca *testCA) create(name string, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+		DNSNames: []string{name},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		tmpl.DNSNames = nil
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey,
+		parentKey)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	file := filepath.Join(ca.dir, name+".pem")
+	ca.write(file, "CERTIFICATE", der)
+	return cert, key, file
+}
+
+func (ca *testCA) write(file, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		ca.t.Fatal(err)
+	}
+}
+
+// tlsServer starts a TLS server with the certificate and key, which requires
+// client certificates issued by clientCA if it isn't nil, and returns its
+// port. Each connection is closed once its handshake is done.
+func tlsServer(t *testing.T, certFile, keyFile string, clientCA *testCA) uint {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCA != nil {
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		tlsConfig.ClientCAs.AddCert(clientCA.cert)
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return uint(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue("mainframe.internal")
+	clientCert, clientKey := ca.issue("proxy3270")
+	port := tlsServer(t, serverCert, serverKey, ca)
+
+	type TestCase struct {
+		Name     string
+		Endpoint EndpointConfig
+		Expected bool // should the handshake succeed?
+	}
+
+	testCases := []TestCase{
+		{"ca and client certificate", EndpointConfig{ServerCA: ca.file,
+			ServerName: "mainframe.internal", ClientCertificate: clientCert,
+			ClientKey: clientKey}, true},
+		{"system roots", EndpointConfig{ServerName: "mainframe.internal",
+			ClientCertificate: clientCert, ClientKey: clientKey}, false},
+		{"wrong server name", EndpointConfig{ServerCA: ca.file,
+			ServerName: "other.internal", ClientCertificate: clientCert,
+			ClientKey: clientKey}, false},
+		{"host name", EndpointConfig{ServerCA: ca.file,
+			ClientCertificate: clientCert, ClientKey: clientKey}, false},
+		{"no client certificate", EndpointConfig{ServerCA: ca.file,
+			ServerName: "mainframe.internal"}, false},
+	}
+
+	for _, tc := range testCases {
+		tc.Endpoint.Host = "127.0.0.1"
+		tc.Endpoint.Port = port
+		ep := &endpoint{EndpointConfig: &tc.Endpoint, server: &ServerConfig{}}
+		tlsConfig, err := ep.tlsClientConfig(&Config{})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.Name, err)
+			continue
+		}
+		conn, err := tls.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))), tlsConfig)
+		if err == nil {
+			// With TLS 1.3, the server reports a problem with our
+			// certificate after the client's side of the handshake is done.
+			_, err = conn.Read(make([]byte, 1))
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			conn.Close()
+		}
+		if (err == nil) != tc.Expected {
+			t.Errorf("%s: handshake error %v; we expected success %v", tc.Name,
+				err, tc.Expected)
+		}
+	}
+
+	bad := &endpoint{EndpointConfig: &EndpointConfig{Host: "127.0.0.1",
+		ClientCertificate: clientCert}, server: &ServerConfig{}}
+	if err := bad.validateTLS(&Config{}); err == nil {
+		t.Errorf("expected an error for clientCertificate without clientKey")
+	}
+}
@@ -0,0 +1,298 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+type sessionState int
+
+const (
+	stateNegotiating sessionState = iota
+	stateMenu
+	stateProxying
+)
+
+// activeSession is the tracking record for a single client connection.
+type activeSession struct {
+	conn  net.Conn
+	state sessionState
+
+	// listenAddr is the configured address of the listener the client
+	// connected to.
+	listenAddr string
+
+	// identity is the user identity from the client's TLS certificate, if
+	// the client presented one.
+	identity string
+
+	// endReason explains why we ended the session, if it was ended by us
+	// rather than by the client or server.
+	endReason string
+
+	// endpoint is the address of the server endpoint the session is
+	// connected to, once it is proxying.
+	endpoint string
+}
+
+// clientName describes the client for log messages.
+func (s *activeSession) clientName() string {
+	if s.identity != "" {
+		return fmt.Sprintf("%s (%s)", s.conn.RemoteAddr(), s.identity)
+	}
+	return s.conn.RemoteAddr().String()
+}
+
+// sessionTracker keeps a record of every client connection currently being
+// handled so we can drain them when the server is shutting down or handing
+// its listeners off to a new process.
+type sessionTracker struct {
+	mu       sync.Mutex
+	sessions map[*activeSession]bool
+
+	// endpoints counts the sessions connected to each server endpoint, by
+	// address.
+	endpoints map[string]int
+
+	// closing is set once we stop accepting new connections. drained is
+	// closed when closing is set and the last session has ended.
+	closing bool
+	drained chan struct{}
+
+	// shuttingDown is set when sessions that haven't reached a target host
+	// yet should be ended.
+	shuttingDown bool
+}
+
+var sessions = newSessionTracker()
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{
+		sessions:  make(map[*activeSession]bool),
+		endpoints: make(map[string]int),
+		drained:   make(chan struct{}),
+	}
+}
+
+// register starts tracking a new client connection. If the server is no
+// longer accepting connections, the connection is not tracked and nil is
+// returned; the caller should close the connection.
+func (t *sessionTracker) register(conn net.Conn) *activeSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing {
+		return nil
+	}
+	s := &activeSession{conn: conn, state: stateNegotiating}
+	t.sessions[s] = true
+	return s
+}
+
+// unregister stops tracking a session once its connection is finished.
+func (t *sessionTracker) unregister(s *activeSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, s)
+	if s.endpoint != "" {
+		t.endpoints[s.endpoint]--
+		if t.endpoints[s.endpoint] == 0 {
+			delete(t.endpoints, s.endpoint)
+		}
+	}
+	if t.closing && len(t.sessions) == 0 {
+		close(t.drained)
+	}
+}
+
+// setConn replaces the connection recorded for the session, for when the
+// original connection gets wrapped (e.g. in TLS) before use.
+func (t *sessionTracker) setConn(s *activeSession, conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.conn = conn
+}
+
+// setState moves the session to a new state. It returns false if the server
+// is shutting down, in which case the state is not changed and the caller
+// should end the session instead of proceeding.
+func (t *sessionTracker) setState(s *activeSession, state sessionState) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.shuttingDown {
+		return false
+	}
+	s.state = state
+	return true
+}
+
+// reserve counts a session on the server endpoint at addr before we
+// connect to it, so that sessions picking an endpoint at the same time see
+// each other. The reservation must be released if the connection fails, or
+// handed to the session with setEndpoint if it succeeds.
+func (t *sessionTracker) reserve(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.endpoints[addr]++
+}
+
+// release gives up a reservation made with reserve.
+func (t *sessionTracker) release(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.endpoints[addr]--
+	if t.endpoints[addr] == 0 {
+		delete(t.endpoints, addr)
+	}
+}
+
+// setEndpoint records the address of the server endpoint the session has
+// connected to, taking over the reservation made for the connection.
+func (t *sessionTracker) setEndpoint(s *activeSession, addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.endpoint = addr
+}
+
+// reserveLeastActive returns the index of the endpoint with the fewest
+// sessions in proportion to its weight, preferring earlier endpoints in a
+// tie, and reserves a session on it. Picking and reserving at once means
+// that a burst of sessions is spread across the endpoints.
+func (t *sessionTracker) reserveLeastActive(eps []*endpoint) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	best, bestActive := 0, t.endpoints[eps[0].address()]
+	for i := 1; i < len(eps); i++ {
+		active := t.endpoints[eps[i].address()]
+		if active*eps[best].weight() < bestActive*eps[i].weight() {
+			best, bestActive = i, active
+		}
+	}
+	t.endpoints[eps[best].address()]++
+	return best
+}
+
+// end closes the session's connection, recording the reason unless the
+// session is already being ended for another reason.
+func (t *sessionTracker) end(s *activeSession, reason string) {
+	t.mu.Lock()
+	if s.endReason == "" {
+		s.endReason = reason
+	}
+	conn := s.conn
+	t.mu.Unlock()
+	conn.Close()
+}
+
+func (t *sessionTracker) endReason(s *activeSession) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return s.endReason
+}
+
+func (t *sessionTracker) isShuttingDown() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.shuttingDown
+}
+
+func (t *sessionTracker) isAccepting() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.closing
+}
+
+// stopAccepting marks the server as no longer taking new connections, but
+// lets all existing sessions carry on as usual. Once every session has
+// ended, the channel returned by drainedChan() is closed.
+func (t *sessionTracker) stopAccepting() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopAcceptingLocked()
+}
+
+func (t *sessionTracker) stopAcceptingLocked() {
+	if t.closing {
+		return
+	}
+	t.closing = true
+	if len(t.sessions) == 0 {
+		close(t.drained)
+	}
+}
+
+func (t *sessionTracker) drainedChan() <-chan struct{} {
+	return t.drained
+}
+
+// beginShutdown marks the server as shutting down and interrupts every
+// session that hasn't yet been handed off to a target host. Those sessions
+// will see their pending read fail and end themselves. Sessions that are
+// already proxying are left alone.
+func (t *sessionTracker) beginShutdown() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.shuttingDown {
+		return
+	}
+	t.stopAcceptingLocked()
+	t.shuttingDown = true
+	for s := range t.sessions {
+		if s.state != stateProxying {
+			s.conn.SetReadDeadline(time.Now())
+		}
+	}
+}
+
+// drain waits up to grace for all sessions to end on their own, then closes
+// the connections of any sessions that remain. It returns the number of
+// sessions that were forcibly closed. beginShutdown must be called first.
+func (t *sessionTracker) drain(grace time.Duration) int {
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+
+	select {
+	case <-t.drained:
+		return 0
+	case <-timer.C:
+	}
+
+	t.mu.Lock()
+	count := len(t.sessions)
+	for s := range t.sessions {
+		if s.endReason == "" {
+			s.endReason = "shutdown grace period expired"
+		}
+		s.conn.Close()
+	}
+	t.mu.Unlock()
+
+	// Give the session goroutines a moment to notice their connections are
+	// gone and clean up after themselves.
+	select {
+	case <-t.drained:
+	case <-time.After(5 * time.Second):
+	}
+
+	return count
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/racingmars/go3270"
+)
+
+// queueRefreshInterval is how often the queue screen is redrawn with the
+// user's current position.
+const queueRefreshInterval = 5 * time.Second
+
+// slot is a request for one of the limited number of concurrent sessions
+// to a target server. Once granted, it must be released when the session
+// ends.
+type slot struct {
+	server string
+	max    int // the server's session limit when the slot was requested
+
+	// ready is closed when the slot is granted.
+	ready   chan struct{}
+	granted bool
+}
+
+// sessionSlots enforces the global and per-server concurrent session
+// limits. Requests that can't be granted right away wait in a single queue,
+// and are granted in order as sessions end.
+type sessionSlots struct {
+	mu     sync.Mutex
+	total  int
+	active map[string]int // by server name
+	queue  []*slot
+}
+
+var slots = newSessionSlots()
+
+func newSessionSlots() *sessionSlots {
+	return &sessionSlots{active: make(map[string]int)}
+}
+
+// request asks for a session slot on the server, which allows at most max
+// concurrent sessions (0 for no limit). The slot may be granted
+// immediately; otherwise the caller should wait on its ready channel, and
+// must cancel it if it gives up waiting.
+func (ss *sessionSlots) request(server string, max int) *slot {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	sl := &slot{server: server, max: max, ready: make(chan struct{})}
+	ss.queue = append(ss.queue, sl)
+	ss.dispatch(currentConfig().MaxSessions)
+	return sl
+}
+
+// release ends the session holding a granted slot, or removes a slot that
+// is still waiting from the queue.
+func (ss *sessionSlots) release(sl *slot) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if sl.granted {
+		sl.granted = false
+		ss.total--
+		ss.active[sl.server]--
+		if ss.active[sl.server] == 0 {
+			delete(ss.active, sl.server)
+		}
+	} else {
+		for i := range ss.queue {
+			if ss.queue[i] == sl {
+				ss.queue = append(ss.queue[:i], ss.queue[i+1:]...)
+				break
+			}
+		}
+	}
+	ss.dispatch(currentConfig().MaxSessions)
+}
+
+// position returns the slot's place in the queue, counting from 1, or 0 if
+// it has been granted. When the global limit is in effect every request
+// ahead of this one counts; otherwise only those for the same server do.
+func (ss *sessionSlots) position(sl *slot) int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if sl.granted {
+		return 0
+	}
+	global := currentConfig().MaxSessions > 0
+	pos := 1
+	for _, other := range ss.queue {
+		if other == sl {
+			break
+		}
+		if global || other.server == sl.server {
+			pos++
+		}
+	}
+	return pos
+}
+
+// dispatch grants queued requests, in order, for as long as there are free
+// slots for them. ss.mu must be held.
+func (ss *sessionSlots) dispatch(globalMax int) {
+	remaining := ss.queue[:0]
+	for _, sl := range ss.queue {
+		if (globalMax > 0 && ss.total >= globalMax) ||
+			(sl.max > 0 && ss.active[sl.server] >= sl.max) {
+			remaining = append(remaining, sl)
+			continue
+		}
+		sl.granted = true
+		ss.total++
+		ss.active[sl.server]++
+		close(sl.ready)
+	}
+	ss.queue = remaining
+}
+
+// waitForSlot gets a session slot for the target server, showing the user
+// a queue screen while they wait if the server is busy. It returns nil
+// without an error if the user pressed PF3 to go back to the menu.
+func waitForSlot(conn net.Conn, devinfo go3270.DevInfo, s *activeSession, target *ServerConfig) (*slot, error) {
+	sl := slots.request(target.Name, target.MaxSessions)
+	select {
+	case <-sl.ready:
+		return sl, nil
+	default:
+	}
+
+	l.Log(InfoLvl, "Client %s queued for server %s", s.clientName(),
+		target.Name)
+
+	// When the slot is granted we interrupt the wait for the user to press
+	// a key, the same way a shutdown does.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-sl.ready:
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	defer conn.SetReadDeadline(time.Time{})
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(queueRefreshInterval))
+		pos := slots.position(sl)
+		if pos == 0 {
+			l.Log(InfoLvl, "Client %s reached the front of the queue for server %s",
+				s.clientName(), target.Name)
+			return sl, nil
+		}
+		if sessions.isShuttingDown() {
+			slots.release(sl)
+			return nil, fmt.Errorf("shutting down")
+		}
+
+		resp, err := go3270.ShowScreenOpts(queueScreen(devinfo, target, pos),
+			nil, conn, go3270.ScreenOpts{
+				AltScreen: devinfo,
+				Codepage:  devinfo.Codepage(),
+			})
+		if err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			slots.release(sl)
+			return nil, err
+		}
+		if resp.AID == go3270.AIDPF3 {
+			slots.release(sl)
+			return nil, nil
+		}
+	}
+}
+
+func queueScreen(devinfo go3270.DevInfo, target *ServerConfig, pos int) go3270.Screen {
+	rows, _ := devinfo.AltDimensions()
+	return go3270.Screen{
+		{Row: 0, Col: 0, Intense: true,
+			Content: "Waiting for " + target.Name},
+		{Row: 2, Col: 0,
+			Content: "All sessions to this service are in use. You will be connected"},
+		{Row: 3, Col: 0,
+			Content: "automatically when one becomes available."},
+		{Row: 5, Col: 0, Content: "Your position in the queue:"},
+		{Row: 5, Col: 28, Intense: true, Content: fmt.Sprintf("%d", pos)},
+		{Row: rows - 2, Col: 0, Content: "PF3 Menu"},
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestSessionSlots(t *testing.T) {
+	// Other tests mustn't see our session limit, so we put back whatever
+	// configuration was in effect before, even if there was none.
+	saved := activeConfig.Load()
+	defer func() {
+		if saved != nil {
+			setConfig(saved.(*Config))
+		} else {
+			activeConfig = atomic.Value{}
+		}
+	}()
+	setConfig(&Config{MaxSessions: 3})
+	ss := newSessionSlots()
+
+	granted := func(sl *slot) bool {
+		select {
+		case <-sl.ready:
+			return true
+		default:
+			return false
+		}
+	}
+
+	a1 := ss.request("A", 2)
+	a2 := ss.request("A", 2)
+	a3 := ss.request("A", 2) // server A is full
+	b1 := ss.request("B", 0) // B has room, so it doesn't wait behind a3
+	b2 := ss.request("B", 0) // the global limit is reached
+	if !granted(a1) || !granted(a2) || granted(a3) || !granted(b1) ||
+		granted(b2) {
+		t.Fatalf("unexpected initial grants")
+	}
+	if p := ss.position(a3); p != 1 {
+		t.Errorf("a3 at position %d; we expected 1", p)
+	}
+	if p := ss.position(b2); p != 2 {
+		t.Errorf("b2 at position %d; we expected 2", p)
+	}
+
+	// Freeing a slot on A goes to the first in line.
+	ss.release(a1)
+	if !granted(a3) || granted(b2) {
+		t.Errorf("a3 should have been granted before b2")
+	}
+
+	// Giving up while waiting leaves the queue.
+	ss.release(b2)
+	if len(ss.queue) != 0 {
+		t.Errorf("queue has %d entries; we expected none", len(ss.queue))
+	}
+
+	ss.release(b1)
+	b3 := ss.request("B", 0)
+	if !granted(b3) {
+		t.Errorf("b3 should have been granted")
+	}
+}
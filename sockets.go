@@ -0,0 +1,217 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// This file handles listening sockets that are passed to us by another
+// process: either systemd socket activation, or an older proxy3270 process
+// handing off its listeners during an upgrade.
+
+// listenFdsStart is the first file descriptor passed in, per the systemd
+// sd_listen_fds(3) convention, which we also use for upgrades.
+const listenFdsStart = 3
+
+// Environment variables used between an old proxy3270 process and its
+// replacement. We can't use LISTEN_PID for the upgrade since we don't know
+// the new process's PID until after it has started.
+const (
+	upgradeFdsEnv   = "PROXY3270_LISTEN_FDS"
+	upgradeReadyEnv = "PROXY3270_READY_FD"
+)
+
+// upgradeReadyTimeout is how long we wait for a new process to report that
+// it has taken over the listeners before giving up on the upgrade.
+const upgradeReadyTimeout = 30 * time.Second
+
+// inherited holds listening sockets passed to us at startup that haven't yet
+// been claimed by a listener configuration.
+var inherited []net.Listener
+
+// loadInheritedListeners picks up any listening sockets passed in by
+// systemd or by a previous proxy3270 process.
+func loadInheritedListeners() error {
+	var count int
+	var err error
+	if fds := os.Getenv(upgradeFdsEnv); fds != "" {
+		count, err = strconv.Atoi(fds)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", upgradeFdsEnv, err)
+		}
+		os.Unsetenv(upgradeFdsEnv)
+	} else if fds := os.Getenv("LISTEN_FDS"); fds != "" {
+		// The sockets are only meant for us if LISTEN_PID matches;
+		// otherwise they were meant for a parent process.
+		if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+			return nil
+		}
+		count, err = strconv.Atoi(fds)
+		if err != nil {
+			return fmt.Errorf("invalid LISTEN_FDS: %v", err)
+		}
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}
+
+	for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "listener"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("inherited file descriptor %d: %v", fd, err)
+		}
+		l.Log(DebugLvl, "Inherited listening socket %s", ln.Addr())
+		inherited = append(inherited, ln)
+	}
+	return nil
+}
+
+// takeInheritedListener returns the inherited socket bound to addr (in
+// host:port form, where a blank host means all interfaces), if there is
+// one, and removes it from the list of unclaimed sockets.
+func takeInheritedListener(addr string) net.Listener {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	for i, ln := range inherited {
+		tcpAddr, ok := ln.Addr().(*net.TCPAddr)
+		if !ok || strconv.Itoa(tcpAddr.Port) != port {
+			continue
+		}
+		if (host == "" && tcpAddr.IP.IsUnspecified()) ||
+			tcpAddr.IP.Equal(net.ParseIP(host)) {
+			inherited = append(inherited[:i], inherited[i+1:]...)
+			return ln
+		}
+	}
+	return nil
+}
+
+// closeUnclaimedListeners closes any inherited sockets that don't match a
+// listener in our configuration.
+func closeUnclaimedListeners() {
+	for _, ln := range inherited {
+		l.Log(WarnLvl, "Closing inherited socket %s: no listener configured for it",
+			ln.Addr())
+		ln.Close()
+	}
+	inherited = nil
+}
+
+// handoffListeners starts a new copy of proxy3270 with the same command
+// line arguments, passing it our listening sockets, and waits for it to
+// report that it is up and running. If this returns without error, the new
+// process is accepting connections and we should stop doing so.
+func handoffListeners(listeners []*listener) error {
+	// Look up the executable by its original name, so that we pick up a new
+	// binary that has been installed over the running one.
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, lsn := range listeners {
+		tcpln, ok := lsn.ln.(*net.TCPListener)
+		if !ok {
+			return fmt.Errorf("can't pass listener %s to a new process",
+				lsn.ln.Addr())
+		}
+		f, err := tcpln.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		upgradeFdsEnv+"="+strconv.Itoa(len(files)),
+		upgradeReadyEnv+"="+strconv.Itoa(listenFdsStart+len(files)))
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+	l.Log(InfoLvl, "Started new process %d; waiting for it to take over",
+		cmd.Process.Pid)
+
+	// The new process writes a byte to the pipe once its listeners are
+	// running. If it exits first, we'll get EOF instead.
+	go cmd.Wait()
+	readyR.SetReadDeadline(time.Now().Add(upgradeReadyTimeout))
+	buf := make([]byte, 1)
+	if _, err := readyR.Read(buf); err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("new process didn't start: %v", err)
+	}
+
+	return nil
+}
+
+// notifyUpgradeReady tells the old process that started us, if any, that we
+// are now accepting connections on the listeners it passed us.
+func notifyUpgradeReady() {
+	fdstr := os.Getenv(upgradeReadyEnv)
+	if fdstr == "" {
+		return
+	}
+	os.Unsetenv(upgradeReadyEnv)
+
+	fd, err := strconv.Atoi(fdstr)
+	if err != nil {
+		l.LogWithErr(ErrorLvl, err, "Invalid %s", upgradeReadyEnv)
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		l.LogWithErr(ErrorLvl, err, "Couldn't notify previous process")
+	}
+}
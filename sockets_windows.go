@@ -0,0 +1,37 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// Socket activation and listener handoff rely on passing file descriptors
+// between processes, which we only support on Unix-like systems.
+
+func loadInheritedListeners() error                  { return nil }
+func takeInheritedListener(addr string) net.Listener { return nil }
+func closeUnclaimedListeners()                       {}
+func notifyUpgradeReady()                            {}
+
+func handoffListeners(listeners []*listener) error {
+	return errors.New("listener handoff is not supported on this platform")
+}
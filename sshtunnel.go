@@ -0,0 +1,381 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHTunnelConfig describes an SSH bastion host that connections to a
+// target server are tunneled through.
+type SSHTunnelConfig struct {
+	// Host is the bastion's address, as host or host:port. The port
+	// defaults to 22.
+	Host string `json:"host"`
+	User string `json:"user"`
+
+	// Key is the private key file to authenticate with, which must not be
+	// protected by a passphrase.
+	Key string `json:"key"`
+
+	// KnownHosts is a file in OpenSSH known_hosts format that the
+	// bastion's host key is verified against.
+	KnownHosts string `json:"knownHosts"`
+}
+
+// sshIdleClose is how long we keep a connection to a bastion open after
+// the last session using it ends.
+const sshIdleClose = 5 * time.Minute
+
+func (c *SSHTunnelConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Host == "" {
+		return errors.New("ssh host missing")
+	}
+	if _, _, err := c.hostPort(); err != nil {
+		return fmt.Errorf("ssh host `%s` invalid: %v", c.Host, err)
+	}
+	if c.User == "" {
+		return errors.New("ssh user missing")
+	}
+	if c.Key == "" {
+		return errors.New("ssh key missing")
+	}
+	if c.KnownHosts == "" {
+		return errors.New("ssh knownHosts missing")
+	}
+	return nil
+}
+
+// hostPort splits the bastion's address into host and port.
+func (c *SSHTunnelConfig) hostPort() (string, uint, error) {
+	host, portstr, err := net.SplitHostPort(c.Host)
+	if err != nil {
+		// No port given.
+		return c.Host, 22, nil
+	}
+	port, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, fmt.Errorf("invalid port `%s`", portstr)
+	}
+	return host, uint(port), nil
+}
+
+// clientConfig loads the key and known hosts files to build the SSH client
+// configuration. They are loaded each time we connect to the bastion, so
+// changes take effect without a restart.
+func (c *SSHTunnelConfig) clientConfig() (*ssh.ClientConfig, error) {
+	pem, err := os.ReadFile(c.Key)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load SSH key %s: %v", c.Key, err)
+	}
+	hostKeyCallback, err := knownhosts.New(c.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load SSH known hosts %s: %v",
+			c.KnownHosts, err)
+	}
+	return &ssh.ClientConfig{
+		User:            c.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+// sshTunnelKey identifies a connection to a bastion that may be shared by
+// sessions to any server with the same tunnel configuration and the same
+// way of reaching the bastion.
+type sshTunnelKey struct {
+	SSHTunnelConfig
+	outboundProxy string
+	sourceAddress string
+}
+
+// sshTunnel is a connection to a bastion and the number of sessions
+// currently using it.
+type sshTunnel struct {
+	key    sshTunnelKey
+	client *ssh.Client
+	active int
+	idle   *time.Timer
+}
+
+// sshTunnelPool holds our open connections to bastions.
+type sshTunnelPool struct {
+	mu      sync.Mutex
+	tunnels map[sshTunnelKey]*sshTunnel
+}
+
+var sshTunnels = &sshTunnelPool{tunnels: make(map[sshTunnelKey]*sshTunnel)}
+
+// dial connects to the endpoint through its server's SSH bastion, reusing
+// an existing connection to the bastion if there is one.
+func (p *sshTunnelPool) dial(config *Config, ep *endpoint,
+	deadline time.Time) (net.Conn, error) {
+
+	target := ep.server
+	addr := ep.address()
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// If a connection we reused turns out to be dead, we try once more with
+	// a new one.
+	for attempt := 0; ; attempt++ {
+		t, reused, err := p.acquire(config, target, deadline)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := t.client.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			l.Log(DebugLvl, "Connected to %s via SSH bastion %s", addr,
+				target.SSH.Host)
+			return &sshTunnelConn{Conn: conn, release: func() { p.release(t) }}, nil
+		}
+		p.release(t)
+
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) || !reused || attempt > 0 {
+			return nil, fmt.Errorf("SSH bastion %s: %v", target.SSH.Host, err)
+		}
+		l.LogWithErr(WarnLvl, err, "Reconnecting to SSH bastion %s",
+			target.SSH.Host)
+		p.remove(t)
+	}
+}
+
+// acquire returns a connection to the bastion, opening a new one if
+// necessary, and counts the caller as one of its users. reused reports
+// whether the connection was already open.
+func (p *sshTunnelPool) acquire(config *Config, target *ServerConfig,
+	deadline time.Time) (t *sshTunnel, reused bool, err error) {
+
+	key := sshTunnelKey{SSHTunnelConfig: *target.SSH}
+	if u := outboundProxy(config, target); u != nil {
+		key.outboundProxy = u.String()
+	}
+	if addr := sourceAddress(config, target); addr != nil {
+		key.sourceAddress = addr.String()
+	}
+	p.mu.Lock()
+	if t := p.tunnels[key]; t != nil {
+		p.use(t)
+		p.mu.Unlock()
+		return t, true, nil
+	}
+	p.mu.Unlock()
+
+	client, err := connectSSH(config, target, deadline)
+	if err != nil {
+		return nil, false, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t := p.tunnels[key]; t != nil {
+		// Someone else connected while we were; use theirs.
+		client.Close()
+		p.use(t)
+		return t, true, nil
+	}
+	t = &sshTunnel{key: key, client: client}
+	p.tunnels[key] = t
+	p.use(t)
+	go func() {
+		err := client.Wait()
+		p.remove(t)
+		l.Log(DebugLvl, "Connection to SSH bastion %s closed: %v", key.Host, err)
+	}()
+	return t, false, nil
+}
+
+// use counts one more user of t. Must be called with p.mu held.
+func (p *sshTunnelPool) use(t *sshTunnel) {
+	t.active++
+	if t.idle != nil {
+		t.idle.Stop()
+		t.idle = nil
+	}
+}
+
+// release counts one less user of t, and arranges for the connection to be
+// closed if it stays unused.
+func (p *sshTunnelPool) release(t *sshTunnel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t.active--
+	if t.active > 0 {
+		return
+	}
+	t.idle = time.AfterFunc(sshIdleClose, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if t.active == 0 && p.tunnels[t.key] == t {
+			delete(p.tunnels, t.key)
+			t.client.Close()
+		}
+	})
+}
+
+// remove closes t and forgets it so that it won't be reused.
+func (p *sshTunnelPool) remove(t *sshTunnel) {
+	p.mu.Lock()
+	if p.tunnels[t.key] == t {
+		delete(p.tunnels, t.key)
+	}
+	p.mu.Unlock()
+	t.client.Close()
+}
+
+// connectSSH opens a new connection to the target's bastion, through the
+// outbound proxy and from the source address the server is configured
+// with, if any.
+func connectSSH(config *Config, target *ServerConfig,
+	deadline time.Time) (*ssh.Client, error) {
+
+	clientConfig, err := target.SSH.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	host, port, _ := target.SSH.hostPort()
+	conn, err := dialTCP(config, target, host, port, deadline)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to SSH bastion %s: %v",
+			target.SSH.Host, err)
+	}
+
+	conn.SetDeadline(deadline)
+	c, chans, reqs, err := ssh.NewClientConn(conn,
+		net.JoinHostPort(host, strconv.Itoa(int(port))), clientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SSH bastion %s: %v", target.SSH.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	l.Log(InfoLvl, "Connected to SSH bastion %s as %s", target.SSH.Host,
+		target.SSH.User)
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// sshTunnelConn is a connection through an SSH bastion, which releases its
+// hold on the bastion connection when closed.
+//
+// SSH channels don't support deadlines, so sshTunnelConn closes the channel
+// when a deadline passes instead. Unlike a real deadline, one that has
+// passed leaves the connection unusable, and the read and write deadlines
+// are the same; we only set deadlines on server connections to give up on
+// servers that stall.
+type sshTunnelConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+
+	mu       sync.Mutex
+	deadline *time.Timer
+	expired  bool
+}
+
+func (c *sshTunnelConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	return n, c.deadlineErr(err)
+}
+
+func (c *sshTunnelConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	return n, c.deadlineErr(err)
+}
+
+// deadlineErr reports a failed read or write as a timeout if it was caused
+// by the deadline closing the channel.
+func (c *sshTunnelConn) deadlineErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expired {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+func (c *sshTunnelConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.deadline != nil {
+		c.deadline.Stop()
+		c.deadline = nil
+	}
+	if t.IsZero() || c.expired {
+		return nil
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(t), func() {
+		c.mu.Lock()
+		// The deadline may have been changed while we were waiting for
+		// the lock.
+		if c.deadline != timer {
+			c.mu.Unlock()
+			return
+		}
+		c.expired = true
+		c.mu.Unlock()
+		c.Conn.Close()
+	})
+	c.deadline = timer
+	return nil
+}
+
+func (c *sshTunnelConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *sshTunnelConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *sshTunnelConn) Close() error {
+	c.SetDeadline(time.Time{})
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// CloseWrite sends EOF to the target through the tunnel.
+func (c *sshTunnelConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
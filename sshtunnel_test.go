@@ -0,0 +1,276 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testBastion is an in-process SSH server that accepts one client key and
+// forwards direct-tcpip channels.
+type testBastion struct {
+	addr        string
+	hostKey     ssh.Signer
+	connections int32
+}
+
+func newTestBastion(t *testing.T, clientKey ssh.PublicKey) *testBastion {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == "tunnel" &&
+				string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.ErrUnexpectedEOF
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	b := &testBastion{addr: ln.Addr().String(), hostKey: hostKey}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn, config)
+		}
+	}()
+	return b
+}
+
+func (b *testBastion) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	atomic.AddInt32(&b.connections, 1)
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		var req struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if newChan.ChannelType() != "direct-tcpip" ||
+			ssh.Unmarshal(newChan.ExtraData(), &req) != nil {
+			newChan.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		target, err := net.Dial("tcp", net.JoinHostPort(req.Host,
+			strconv.Itoa(int(req.Port))))
+		if err != nil {
+			newChan.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		go ssh.DiscardRequests(chReqs)
+		go func() {
+			io.Copy(ch, target)
+			ch.CloseWrite()
+		}()
+		go func() {
+			io.Copy(target, ch)
+			target.Close()
+		}()
+	}
+}
+
+// echoServer accepts connections and echoes back whatever it receives.
+func echoServer(t *testing.T) *net.TCPAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+// newTestTunnel starts a bastion and writes a client key and known_hosts
+// file for it, returning the bastion, the tunnel configuration to reach it,
+// and the client key.
+func newTestTunnel(t *testing.T) (*testBastion, *SSHTunnelConfig, ssh.Signer) {
+	dir := t.TempDir()
+	_, clientPriv, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	clientSigner, _ := ssh.NewSignerFromKey(clientPriv)
+
+	bastion := newTestBastion(t, clientSigner.PublicKey())
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(bastion.addr)},
+		bastion.hostKey.PublicKey())
+	if err := os.WriteFile(knownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return bastion, &SSHTunnelConfig{
+		Host:       bastion.addr,
+		User:       "tunnel",
+		Key:        keyFile,
+		KnownHosts: knownHostsFile,
+	}, clientSigner
+}
+
+// stallServer accepts connections and reads from them, but never sends
+// anything.
+func stallServer(t *testing.T) *net.TCPAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func TestSSHTunnel(t *testing.T) {
+	bastion, tunnel, clientSigner := newTestTunnel(t)
+	echo := echoServer(t)
+	config := &Config{}
+	target := &ServerConfig{
+		EndpointConfig: EndpointConfig{Host: "127.0.0.1", Port: uint(echo.Port)},
+		SSH:            tunnel,
+	}
+
+	// Two sessions should share one connection to the bastion.
+	for i := 0; i < 2; i++ {
+		conn, _, err := connectServer(config, target, nil, nil)
+		if err != nil {
+			t.Fatalf("session %d: unexpected error: %v", i, err)
+		}
+		conn.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("session %d: read `%s` (%v); we expected `hello`", i, buf, err)
+		}
+		defer conn.Close()
+	}
+	if n := atomic.LoadInt32(&bastion.connections); n != 1 {
+		t.Errorf("got %d connections to the bastion; we expected 1", n)
+	}
+
+	// A bastion whose host key isn't the one we know must be refused.
+	impostor := newTestBastion(t, clientSigner.PublicKey())
+	line := knownhosts.Line([]string{knownhosts.Normalize(impostor.addr)},
+		bastion.hostKey.PublicKey())
+	os.WriteFile(tunnel.KnownHosts, []byte(line+"\n"), 0600)
+	target.SSH.Host = impostor.addr
+	if conn, _, err := connectServer(config, target, nil, nil); err == nil {
+		conn.Close()
+		t.Error("connected to a bastion with the wrong host key")
+	}
+	if n := atomic.LoadInt32(&impostor.connections); n != 0 {
+		t.Errorf("impostor bastion got %d connections; we expected none", n)
+	}
+}
+
+func TestSSHTunnelDeadline(t *testing.T) {
+	_, tunnel, _ := newTestTunnel(t)
+	stall := stallServer(t)
+	config := &Config{Timeouts: &TimeoutsConfig{
+		ServerTLSHandshake: Duration(200 * time.Millisecond),
+	}}
+	target := &ServerConfig{
+		EndpointConfig: EndpointConfig{
+			Host:   "127.0.0.1",
+			Port:   uint(stall.Port),
+			UseTLS: true,
+		},
+		SSH: tunnel,
+	}
+
+	// The target never answers the TLS handshake, so the handshake timeout
+	// must end it even though the SSH channel has no deadlines of its own.
+	result := make(chan error, 1)
+	go func() {
+		conn, _, err := connectServer(config, target, nil, nil)
+		if err == nil {
+			conn.Close()
+		}
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if !isTimeout(err) {
+			t.Errorf("got error %v; we expected a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("TLS handshake through the tunnel didn't time out")
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// TimeoutsConfig sets how long each phase of a session may take. Timeouts
+// may be set globally and overridden for individual servers, although the
+// ones that apply before the user has picked a server (negotiation,
+// tlsHandshake, menuIdle, and menuIdleWarning) can only be set globally. A
+// timeout left at zero takes the default; the idle and session duration
+// limits are disabled by default.
+type TimeoutsConfig struct {
+	Negotiation        Duration `json:"negotiation"`
+	TLSHandshake       Duration `json:"tlsHandshake"`
+	MenuIdle           Duration `json:"menuIdle"`
+	MenuIdleWarning    Duration `json:"menuIdleWarning"`
+	Dial               Duration `json:"dial"`
+	ServerTLSHandshake Duration `json:"serverTLSHandshake"`
+	SessionIdle        Duration `json:"sessionIdle"`
+	MaxSession         Duration `json:"maxSession"`
+}
+
+var defaultTimeouts = &TimeoutsConfig{
+	Negotiation:        Duration(30 * time.Second),
+	TLSHandshake:       Duration(30 * time.Second),
+	Dial:               Duration(15 * time.Second),
+	ServerTLSHandshake: Duration(30 * time.Second),
+}
+
+// timeouts returns the timeouts in effect for a session to target, or for
+// the parts of a session before a target is selected if target is nil.
+func (c *Config) timeouts(target *ServerConfig) *TimeoutsConfig {
+	t := defaultTimeouts.merge(c.Timeouts)
+	if target != nil {
+		t = t.merge(target.Timeouts)
+	}
+	return t
+}
+
+// merge returns a new set of timeouts with the non-zero settings in
+// override taking precedence over those in t. Either may be nil.
+func (t *TimeoutsConfig) merge(override *TimeoutsConfig) *TimeoutsConfig {
+	var merged TimeoutsConfig
+	if t != nil {
+		merged = *t
+	}
+	if override == nil {
+		return &merged
+	}
+	if override.Negotiation != 0 {
+		merged.Negotiation = override.Negotiation
+	}
+	if override.TLSHandshake != 0 {
+		merged.TLSHandshake = override.TLSHandshake
+	}
+	if override.MenuIdle != 0 {
+		merged.MenuIdle = override.MenuIdle
+	}
+	if override.MenuIdleWarning != 0 {
+		merged.MenuIdleWarning = override.MenuIdleWarning
+	}
+	if override.Dial != 0 {
+		merged.Dial = override.Dial
+	}
+	if override.ServerTLSHandshake != 0 {
+		merged.ServerTLSHandshake = override.ServerTLSHandshake
+	}
+	if override.SessionIdle != 0 {
+		merged.SessionIdle = override.SessionIdle
+	}
+	if override.MaxSession != 0 {
+		merged.MaxSession = override.MaxSession
+	}
+	return &merged
+}
+
+// validate checks the timeouts. If server is true, the timeouts are a
+// server's overrides, which can't include the ones that apply before a
+// server is selected.
+func (t *TimeoutsConfig) validate(server bool) error {
+	if t == nil {
+		return nil
+	}
+	if t.Negotiation < 0 || t.TLSHandshake < 0 || t.MenuIdle < 0 ||
+		t.MenuIdleWarning < 0 || t.Dial < 0 || t.ServerTLSHandshake < 0 ||
+		t.SessionIdle < 0 || t.MaxSession < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	if server && (t.Negotiation != 0 || t.TLSHandshake != 0 ||
+		t.MenuIdle != 0 || t.MenuIdleWarning != 0) {
+		return fmt.Errorf("negotiation, tlsHandshake, menuIdle, and " +
+			"menuIdleWarning timeouts can only be set globally")
+	}
+	if t.MenuIdleWarning != 0 && t.MenuIdleWarning >= t.MenuIdle {
+		return fmt.Errorf("menuIdleWarning must be shorter than menuIdle")
+	}
+	return nil
+}
+
+// isTimeout reports whether err is the result of a deadline passing.
+func isTimeout(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// idleWatchdog calls a function once there has been no activity for a
+// period of time. Activity is reported with touch().
+type idleWatchdog struct {
+	mu      sync.Mutex
+	idle    time.Duration
+	last    time.Time
+	timer   *time.Timer
+	stopped bool
+	onIdle  func()
+}
+
+// newIdleWatchdog starts a watchdog that calls onIdle after idle has passed
+// without activity. If idle is zero, it returns nil, which is a watchdog
+// that never fires.
+func newIdleWatchdog(idle time.Duration, onIdle func()) *idleWatchdog {
+	if idle <= 0 {
+		return nil
+	}
+	w := &idleWatchdog{idle: idle, last: time.Now(), onIdle: onIdle}
+	w.mu.Lock()
+	w.timer = time.AfterFunc(idle, w.check)
+	w.mu.Unlock()
+	return w
+}
+
+func (w *idleWatchdog) touch() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.last = time.Now()
+	w.mu.Unlock()
+}
+
+func (w *idleWatchdog) stop() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.stopped = true
+	w.timer.Stop()
+	w.mu.Unlock()
+}
+
+// check runs when the timer expires. Rather than resetting the timer on
+// every bit of activity, we look at how long it has really been idle and
+// either fire or wait out the remainder.
+func (w *idleWatchdog) check() {
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	remaining := w.idle - time.Since(w.last)
+	if remaining > 0 {
+		w.timer.Reset(remaining)
+		w.mu.Unlock()
+		return
+	}
+	w.stopped = true
+	w.mu.Unlock()
+	w.onIdle()
+}
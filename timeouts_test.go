@@ -0,0 +1,88 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeouts(t *testing.T) {
+	config := &Config{Timeouts: &TimeoutsConfig{
+		MenuIdle:    Duration(10 * time.Minute),
+		SessionIdle: Duration(time.Hour),
+	}}
+	server := &ServerConfig{Timeouts: &TimeoutsConfig{
+		Dial:        Duration(5 * time.Second),
+		SessionIdle: Duration(2 * time.Hour),
+	}}
+
+	global := config.timeouts(nil)
+	if global.MenuIdle != Duration(10*time.Minute) ||
+		global.SessionIdle != Duration(time.Hour) ||
+		global.Negotiation != defaultTimeouts.Negotiation ||
+		global.Dial != defaultTimeouts.Dial {
+		t.Errorf("unexpected global timeouts: %+v", global)
+	}
+
+	merged := config.timeouts(server)
+	if merged.Dial != Duration(5*time.Second) ||
+		merged.SessionIdle != Duration(2*time.Hour) ||
+		merged.MenuIdle != Duration(10*time.Minute) ||
+		merged.ServerTLSHandshake != defaultTimeouts.ServerTLSHandshake {
+		t.Errorf("unexpected server timeouts: %+v", merged)
+	}
+
+	if err := (&TimeoutsConfig{MenuIdle: 1}).validate(true); err == nil {
+		t.Errorf("expected menuIdle to be refused on a server")
+	}
+	if err := (&TimeoutsConfig{MenuIdle: 1}).validate(false); err != nil {
+		t.Errorf("unexpected error for global menuIdle: %v", err)
+	}
+	if err := (&TimeoutsConfig{Dial: -1}).validate(false); err == nil {
+		t.Errorf("expected a negative timeout to be refused")
+	}
+}
+
+func TestIdleWatchdog(t *testing.T) {
+	fired := make(chan struct{})
+	w := newIdleWatchdog(100*time.Millisecond, func() { close(fired) })
+
+	// Activity keeps it from firing.
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		w.touch()
+	}
+	select {
+	case <-fired:
+		t.Fatalf("watchdog fired despite activity")
+	default:
+	}
+
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatalf("watchdog didn't fire after going idle")
+	}
+
+	if newIdleWatchdog(0, func() {}) != nil {
+		t.Errorf("expected no watchdog for a zero idle time")
+	}
+}
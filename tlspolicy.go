@@ -0,0 +1,184 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// TLSPolicy restricts the protocol versions, cipher suites, and other
+// parameters used for TLS connections. A policy may be set globally and
+// overridden for individual listeners and servers; any setting left empty
+// in an override falls back to the global setting, and any setting left
+// empty there falls back to the Go defaults.
+type TLSPolicy struct {
+	MinVersion       string   `json:"minVersion"`
+	MaxVersion       string   `json:"maxVersion"`
+	CipherSuites     []string `json:"cipherSuites"`
+	CurvePreferences []string `json:"curvePreferences"`
+	SessionTickets   *bool    `json:"sessionTickets"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// merge returns a new policy with the settings in override taking
+// precedence over those in p. Either may be nil.
+func (p *TLSPolicy) merge(override *TLSPolicy) *TLSPolicy {
+	var merged TLSPolicy
+	if p != nil {
+		merged = *p
+	}
+	if override == nil {
+		return &merged
+	}
+	if override.MinVersion != "" {
+		merged.MinVersion = override.MinVersion
+	}
+	if override.MaxVersion != "" {
+		merged.MaxVersion = override.MaxVersion
+	}
+	if len(override.CipherSuites) > 0 {
+		merged.CipherSuites = override.CipherSuites
+	}
+	if len(override.CurvePreferences) > 0 {
+		merged.CurvePreferences = override.CurvePreferences
+	}
+	if override.SessionTickets != nil {
+		merged.SessionTickets = override.SessionTickets
+	}
+	return &merged
+}
+
+// validate checks that every setting in the policy is one we recognize.
+func (p *TLSPolicy) validate() error {
+	if p == nil {
+		return nil
+	}
+	return p.apply(&tls.Config{})
+}
+
+// apply sets the policy's parameters on cfg.
+func (p *TLSPolicy) apply(cfg *tls.Config) error {
+	if p == nil {
+		return nil
+	}
+
+	if p.MinVersion != "" {
+		v, ok := tlsVersions[p.MinVersion]
+		if !ok {
+			return fmt.Errorf("unknown TLS version `%s`", p.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+	if p.MaxVersion != "" {
+		v, ok := tlsVersions[p.MaxVersion]
+		if !ok {
+			return fmt.Errorf("unknown TLS version `%s`", p.MaxVersion)
+		}
+		cfg.MaxVersion = v
+	}
+	if cfg.MinVersion != 0 && cfg.MaxVersion != 0 &&
+		cfg.MinVersion > cfg.MaxVersion {
+		return fmt.Errorf("TLS minVersion %s is above maxVersion %s",
+			p.MinVersion, p.MaxVersion)
+	}
+
+	if len(p.CipherSuites) > 0 {
+		cfg.CipherSuites = nil
+		for _, name := range p.CipherSuites {
+			suite := cipherSuite(name)
+			if suite == nil {
+				return fmt.Errorf("unknown TLS cipher suite `%s`", name)
+			}
+			// Go ignores TLS 1.3 suites in the list, so accepting one
+			// would leave TLS 1.2 unrestricted without saying so.
+			if len(suite.SupportedVersions) == 1 &&
+				suite.SupportedVersions[0] == tls.VersionTLS13 {
+				return fmt.Errorf("TLS cipher suite `%s` is TLS 1.3 only; "+
+					"TLS 1.3 cipher suites are not configurable (see README)",
+					name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, suite.ID)
+		}
+	}
+
+	if len(p.CurvePreferences) > 0 {
+		cfg.CurvePreferences = nil
+		for _, name := range p.CurvePreferences {
+			id, ok := tlsCurves[name]
+			if !ok {
+				return fmt.Errorf("unknown TLS curve `%s`", name)
+			}
+			cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+		}
+	}
+
+	if p.SessionTickets != nil {
+		cfg.SessionTicketsDisabled = !*p.SessionTickets
+	}
+
+	return nil
+}
+
+// cipherSuite looks up a cipher suite by its standard name, e.g.
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, returning nil if there is none.
+func cipherSuite(name string) *tls.CipherSuite {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite
+		}
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return suite
+		}
+	}
+	return nil
+}
+
+// tlsVersionName returns the short name (e.g. "1.2") of a TLS version.
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// describeTLS summarizes the negotiated parameters of a TLS connection for
+// log messages.
+func describeTLS(state tls.ConnectionState) string {
+	return fmt.Sprintf("TLS %s, %s", tlsVersionName(state.Version),
+		tls.CipherSuiteName(state.CipherSuite))
+}
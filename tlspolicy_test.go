@@ -0,0 +1,76 @@
+/*
+ * Copyright 2020-2021 by Matthew R. Wilson <mwilson@mattwilson.org>
+ *
+ * This file is part of proxy3270.
+ *
+ * proxy3270 is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * proxy3270 is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with proxy3270. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestTLSPolicy(t *testing.T) {
+	disabled := false
+	global := &TLSPolicy{
+		MinVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+	}
+	override := &TLSPolicy{
+		MinVersion:     "1.3",
+		SessionTickets: &disabled,
+	}
+
+	var cfg tls.Config
+	if err := global.merge(override).apply(&cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.MinVersion != tls.VersionTLS13 {
+		t.Errorf("override minVersion not applied: got %x", cfg.MinVersion)
+	}
+	if len(cfg.CipherSuites) != 1 ||
+		cfg.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("global cipher suites not applied: got %v", cfg.CipherSuites)
+	}
+	if !cfg.SessionTicketsDisabled {
+		t.Errorf("session tickets should be disabled")
+	}
+
+	// Merging must not modify the global policy
+	if global.MinVersion != "1.2" || global.SessionTickets != nil {
+		t.Errorf("global policy was modified by merge")
+	}
+
+	// A nil global policy is allowed
+	var nilPolicy *TLSPolicy
+	if err := nilPolicy.merge(nil).validate(); err != nil {
+		t.Errorf("empty policy should be valid: %v", err)
+	}
+
+	bad := []*TLSPolicy{
+		{MinVersion: "1.4"},
+		{MinVersion: "1.3", MaxVersion: "1.2"},
+		{CipherSuites: []string{"TLS_NOT_A_REAL_SUITE"}},
+		{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+		{CurvePreferences: []string{"P999"}},
+	}
+	for _, p := range bad {
+		if err := p.validate(); err == nil {
+			t.Errorf("expected policy %+v to be invalid", *p)
+		}
+	}
+}